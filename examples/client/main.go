@@ -15,18 +15,36 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/gdotgordon/rate_limiter/limiter"
 	"github.com/gdotgordon/rate_limiter/restclient"
 )
 
 var (
 	concurrency = flag.Int("concurrency", 5, "number of goroutines")
 	port        = flag.Int("port", 8080, "port limiter server is listening on")
+	rate        = flag.Int("rate", 0,
+		"requests per second to pace the client to (0 sleeps randomly instead)")
+	maxWait = flag.Duration("maxwait", -1,
+		"how long to ask the server to wait for a token (negative uses its timeout)")
 )
 
 func main() {
 	flag.Parse()
-	cli, err := restclient.NewEventService("http://localhost:" +
-		strconv.Itoa(*port))
+	var opts []restclient.Option
+	if *rate > 0 {
+		// All goroutines share the one limiter, so the total rate is paced.
+		l, err := limiter.NewBucketLimiter(*rate, limiter.Sec, 1)
+		if err != nil {
+			log.Fatalf("Creating limiter, error: %v\n", err)
+		}
+		opts = append(opts, restclient.WithTransport(
+			restclient.NewLimitedTransport(nil, l, 0)))
+	}
+	if *maxWait >= 0 {
+		opts = append(opts, restclient.WithMaxWait(*maxWait))
+	}
+	cli, err := restclient.NewEventService("http://localhost:"+
+		strconv.Itoa(*port), opts...)
 	if err != nil {
 		log.Fatalf("Creating rest client, error: %v\n", err)
 	}
@@ -64,6 +82,9 @@ func main() {
 				if done {
 					break
 				}
+				if *rate > 0 {
+					continue
+				}
 				time.Sleep(
 					time.Duration(int64(rand.Intn(2000)) * int64(time.Millisecond)))
 			}
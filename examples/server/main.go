@@ -11,8 +11,10 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gdotgordon/rate_limiter/limiter"
@@ -26,19 +28,188 @@ var (
 	ops      = flag.Int("ops", 600, "how many ops per specifed interval")
 	interval = flag.Int("interval", int(limiter.Min), "Operations per time")
 	burst    = flag.Int("burst", 1, "Burst rate for limiter")
+	bytes    = flag.Bool("bytes", false,
+		"Charge a token per byte of the request body, rather than per request")
+	upload = flag.Int("upload", 0,
+		"Bytes per second forwarded to the proxied service (0 is unlimited)")
+	maxConns = flag.Int("maxconns", 0,
+		"Maximum concurrent connections per client IP (0 is unlimited)")
+	perClient = flag.Bool("perclient", false,
+		"Give each client IP its own limiter, rather than sharing one")
+	rules = flag.String("rules", "",
+		"JSON file of rules mapping routes to limit policies (reloaded on change)")
+	adminPort = flag.Int("admin", 0, "port to serve the admin API on (0 is off)")
+	adminHost = flag.String("adminhost", "127.0.0.1",
+		"interface to serve the admin API on (empty is all)")
+	adminUsers = flag.String("adminusers", "",
+		"file of user:password lines the admin API authenticates against (empty is none)")
+	reject = flag.Int("reject", http.StatusServiceUnavailable,
+		"status code for requests turned away by the limiter (429 or 503)")
+	probe = flag.String("probe", "",
+		"path on the proxied service to probe for readiness (empty is off)")
+	replicas = flag.Int("replicas", 1,
+		"Number of proxied service replicas to balance requests over")
+	maxWaiters = flag.Int("maxwaiters", 0,
+		"Maximum requests waiting for a token, beyond which they're rejected (0 is unbounded)")
+	breaker = flag.Bool("breaker", false,
+		"Fail fast while the proxied service is failing or slow")
+	maxWait = flag.Duration("maxwait", 0,
+		"Ceiling on how long clients may ask to wait for a token (0 ignores them)")
+	certFile = flag.String("cert", "",
+		"PEM certificate file to terminate TLS with (empty is plain HTTP)")
+	keyFile  = flag.String("key", "", "PEM key file for the TLS certificate")
+	clientCA = flag.String("clientca", "",
+		"PEM CA bundle to verify client certificates against (empty is none)")
+	accessLog = flag.String("accesslog", "",
+		"file to write the JSON access log to, rotated at 100MB (empty is off)")
+	allowFile = flag.String("allow", "",
+		"file of networks, one per line, whose requests aren't limited")
+	denyFile = flag.String("deny", "",
+		"file of networks, one per line, whose requests are refused")
+	adaptive = flag.String("adaptive", "",
+		"adapt a concurrency limit to backend latency, with \"aimd\" or \"gradient\" (empty is off)")
+	backpressure = flag.Bool("backpressure", false,
+		"forward fewer requests while the backend answers 429 or 503")
+	idempotency = flag.Duration("idempotency", 0,
+		"how long to remember responses to replay for retries with the same Idempotency-Key (0 is off)")
 )
 
 func main() {
 	flag.Parse()
-	p, err := limiter.NewPulseLimiter(*ops, limiter.IntervalType(*interval),
-		*burst)
-	if err != nil {
-		log.Fatal("Pulser creation failed: %v\n", err)
+	opts := []server.Option{server.WithRejectStatus(*reject)}
+	if *bytes {
+		opts = append(opts, server.WithCostMode(server.CostBytes))
+	}
+	if *accessLog != "" {
+		rf, err := server.NewRotatingFile(*accessLog, 100<<20, 5)
+		if err != nil {
+			log.Fatalf("Opening access log failed: %v\n", err)
+		}
+		defer rf.Close()
+		opts = append(opts, server.WithAccessLog(rf))
+	}
+	switch *adaptive {
+	case "":
+	case "aimd":
+		opts = append(opts, server.WithAdaptiveConcurrency(
+			limiter.NewAdaptiveLimiter(&limiter.AIMD{Threshold: *timeout},
+				20, 1, 1000)))
+	case "gradient":
+		opts = append(opts, server.WithAdaptiveConcurrency(
+			limiter.NewAdaptiveLimiter(&limiter.Gradient{}, 20, 1, 1000)))
+	default:
+		log.Fatalf("Unknown adaptive algorithm: %s\n", *adaptive)
+	}
+	if *backpressure {
+		opts = append(opts, server.WithBackpressure(server.BackpressureConfig{}))
+	}
+	if *idempotency > 0 {
+		opts = append(opts, server.WithIdempotency(*idempotency, 0))
+	}
+	if *allowFile != "" {
+		set, err := server.LoadIPSet(*allowFile)
+		if err != nil {
+			log.Fatalf("Loading allow list failed: %v\n", err)
+		}
+		opts = append(opts, server.WithAllowList(set, nil))
+	}
+	if *denyFile != "" {
+		set, err := server.LoadIPSet(*denyFile)
+		if err != nil {
+			log.Fatalf("Loading deny list failed: %v\n", err)
+		}
+		opts = append(opts, server.WithDenyList(set))
+	}
+	if *certFile != "" {
+		opts = append(opts, server.WithTLS(server.TLSFiles{CertFile: *certFile,
+			KeyFile: *keyFile, ClientCAFile: *clientCA}))
+	}
+	if *maxWait > 0 {
+		opts = append(opts, server.WithMaxClientWait(*maxWait))
+	}
+
+	// Creates a limiter that reports the requests it turns away.
+	newLimiter := func(key string) (limiter.Limiter, error) {
+		var p limiter.Limiter
+		var err error
+		if *bytes {
+			// The rate is in bytes, which is too fine-grained for a token loop.
+			p, err = limiter.NewBucketLimiter(*ops,
+				limiter.IntervalType(*interval), *burst)
+		} else {
+			p, err = limiter.NewPulseLimiter(*ops,
+				limiter.IntervalType(*interval), *burst)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if *maxWaiters > 0 {
+			// Serve the freshest requests first when overloaded.
+			p = limiter.NewQueue(p, *maxWaiters, limiter.AdaptiveLIFO, 0)
+		}
+		return limiter.Observe(p, key, limiter.ObserverFuncs{
+			Timeout: func(key string, wait time.Duration) {
+				log.Printf("%s: request limited after %v\n", key, wait)
+			},
+		}), nil
+	}
+
+	var lim limiter.Limiter
+	if *perClient {
+		reg := limiter.NewRegistry(newLimiter, 10*time.Minute, 10000)
+		opts = append(opts, server.WithKeyedLimits(reg, server.RemoteIPKey()))
+	} else {
+		var err error
+		if lim, err = newLimiter("events"); err != nil {
+			log.Fatalf("Limiter creation failed: %v\n", err)
+		}
+	}
+
+	if *rules != "" {
+		// The rules are reloaded whenever the file changes, or on SIGHUP.
+		opts = append(opts, server.WithRulesFile(*rules, 0))
+	}
+
+	if *adminPort > 0 {
+		opts = append(opts, server.WithAdminPort(*adminPort),
+			server.WithAdminHost(*adminHost))
+		if *adminUsers != "" {
+			auth, err := server.LoadAdminCredentials(*adminUsers)
+			if err != nil {
+				log.Fatalf("Loading admin users failed: %v\n", err)
+			}
+			opts = append(opts, server.WithAdminAuth(auth))
+		}
+	}
+
+	if *upload > 0 {
+		u, err := limiter.NewBucketLimiter(*upload, limiter.Sec, *upload)
+		if err != nil {
+			log.Fatalf("Upload limiter creation failed: %v\n", err)
+		}
+		opts = append(opts, server.WithUploadLimiter(u))
+	}
+
+	if *probe != "" {
+		opts = append(opts, server.WithBackendProbe(*probe, 0))
+	}
+
+	if *breaker {
+		opts = append(opts, server.WithCircuitBreaker(server.BreakerConfig{}))
+	}
+
+	if *maxConns > 0 {
+		opts = append(opts, server.WithMaxConnsPerIP(*maxConns))
 	}
 
 	// Simple proxied server that the limiter server will talk to.
-	ts := httptest.NewServer(http.HandlerFunc(
+	handler := http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" && *probe != "" && r.URL.Path == *probe {
+				// Answer the readiness probe.
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 			if r.Method != "POST" {
 				http.Error(w, "Unsupported method", http.StatusNotImplemented)
 				return
@@ -59,15 +230,42 @@ func main() {
 			}
 			w.Header().Add("Location", surl+"/12345")
 			w.WriteHeader(http.StatusCreated)
-		}))
+		})
+	ts := httptest.NewServer(handler)
 	defer ts.Close()
 
-	server := server.NewLimiterServer(*port, p, *timeout, ts.URL)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		server.Start(context.Background())
-	}()
-	wg.Wait()
+	if *replicas > 1 {
+		backends := []server.Backend{{URL: ts.URL}}
+		for i := 1; i < *replicas; i++ {
+			rs := httptest.NewServer(handler)
+			defer rs.Close()
+			backends = append(backends, server.Backend{URL: rs.URL})
+		}
+		opts = append(opts, server.WithBackends(server.LeastOutstanding,
+			backends...))
+	}
+
+	server := server.NewLimiterServer(*port, lim, *timeout, ts.URL, opts...)
+
+	// Shut down cleanly on an interrupt, and reload the rules on SIGHUP.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT,
+		syscall.SIGTERM)
+	defer stop()
+	if *rules != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := server.Reload(); err != nil {
+					log.Printf("Reload on SIGHUP failed: %v\n", err)
+				} else {
+					log.Printf("Rules reloaded on SIGHUP\n")
+				}
+			}
+		}()
+	}
+
+	if err := server.Start(ctx); err != nil {
+		log.Fatalf("Server failed: %v\n", err)
+	}
 }
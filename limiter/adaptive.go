@@ -0,0 +1,207 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// An AdaptiveLimiter limits how many requests may be in flight at once,
+// rather than how many may start per interval, and works out the limit
+// for itself from the round trip times of the requests.  While the
+// service being protected keeps up, its latency stays flat and the limit
+// grows, and once it falls behind, requests start to queue inside it,
+// its latency goes up, and the limit comes down.  This way, the limit
+// follows the capacity of the service as it changes, rather than having
+// to be tuned for its worst day.
+//
+// A request takes a slot with Acquire, and gives it back with the
+// release function, along with the round trip time it measured and
+// whether it was dropped, such as by timing out or failing with an
+// overload error.  The Algorithm decides how the limit moves.
+type AdaptiveLimiter struct {
+	algorithm Algorithm
+	min, max  int
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+}
+
+// An Algorithm adjusts the concurrency limit of an AdaptiveLimiter for
+// each request that completes, given its round trip time, the number of
+// requests that were in flight when it was sent, and whether it was
+// dropped.  It is called with the limiter's lock held, so it may keep
+// state of its own without locking it.
+type Algorithm interface {
+	Update(limit float64, rtt time.Duration, inflight int,
+		dropped bool) float64
+}
+
+// AIMD is the additive increase, multiplicative decrease algorithm, as
+// used by TCP congestion control.  For every limit's worth of requests
+// that complete within the latency threshold while the limit is in use,
+// the limit goes up by one, and for every limit's worth that are dropped
+// or slower than that, it is cut back by the backoff factor.  The
+// threshold is required, and the backoff defaults to 0.9.
+type AIMD struct {
+	Threshold time.Duration
+	Backoff   float64
+}
+
+// Update implements the Algorithm interface.
+func (a *AIMD) Update(limit float64, rtt time.Duration, inflight int,
+	dropped bool) float64 {
+	if dropped || rtt > a.Threshold {
+		backoff := a.Backoff
+		if backoff <= 0 || backoff >= 1 {
+			backoff = 0.9
+		}
+		return limit * math.Pow(backoff, 1/limit)
+	}
+	// Only grow the limit if it's being used, or it grows without bound
+	// while traffic is light.
+	if float64(inflight)*2 >= limit {
+		return limit + 1/limit
+	}
+	return limit
+}
+
+// Defaults for the gradient algorithm.
+const (
+	defaultTolerance   = 1.5
+	defaultSmoothing   = 0.2
+	defaultMinRTTReset = 5000
+)
+
+// Gradient compares each round trip time with the lowest one seen, which
+// is taken to be that of the service when nothing is queued inside it.
+// The limit is scaled by their ratio, allowing for the latency to be up
+// to the tolerance times the lowest one before cutting back, and then
+// has room added for a queue of the square root of the limit, so that
+// it can grow.  The new limit is smoothed into the old one, a limit's
+// worth of requests at a time.
+//
+// Every so many requests, the limit drops to its square root, and the
+// lowest round trip time is measured afresh, so that a service that has
+// become slower for good isn't cut back forever, and one whose queue
+// never drains doesn't fool it into taking a long round trip time for
+// the lowest one.  Zero values are replaced by a tolerance of 1.5,
+// smoothing of 0.2, and a reset every 5000 requests.
+type Gradient struct {
+	Tolerance   float64
+	Smoothing   float64
+	MinRTTReset int
+
+	minRTT  time.Duration
+	samples int
+}
+
+// Update implements the Algorithm interface.
+func (g *Gradient) Update(limit float64, rtt time.Duration, inflight int,
+	dropped bool) float64 {
+	tolerance, smoothing, reset := g.Tolerance, g.Smoothing, g.MinRTTReset
+	if tolerance < 1 {
+		tolerance = defaultTolerance
+	}
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = defaultSmoothing
+	}
+	if reset <= 0 {
+		reset = defaultMinRTTReset
+	}
+
+	if g.samples++; g.samples >= reset {
+		// Drain any queue, so that the lowest round trip time can be
+		// measured afresh.
+		g.samples, g.minRTT = 0, 0
+		return math.Sqrt(limit)
+	}
+	if rtt > 0 && (g.minRTT == 0 || rtt < g.minRTT) {
+		g.minRTT = rtt
+	}
+	// Each request only moves the limit its share of the way, so that it
+	// moves by the smoothing for every limit's worth of requests.
+	smoothing /= math.Max(1, limit)
+	if dropped {
+		return limit * (1 - smoothing/2)
+	}
+	if g.minRTT == 0 || rtt <= 0 || float64(inflight)*2 < limit {
+		// No gradient, or the limit isn't being used.
+		return limit
+	}
+
+	gradient := math.Max(0.5, math.Min(1, tolerance*float64(g.minRTT)/
+		float64(rtt)))
+	target := limit*gradient + math.Sqrt(limit)
+	return limit*(1-smoothing) + target*smoothing
+}
+
+// NewAdaptiveLimiter creates a limiter that starts with the initial
+// concurrency limit, and keeps it between the minimum and maximum, with
+// a maximum of 0 meaning no bound.
+func NewAdaptiveLimiter(algorithm Algorithm, initial, min,
+	max int) *AdaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if initial < min {
+		initial = min
+	}
+	if max > 0 && initial > max {
+		initial = max
+	}
+	return &AdaptiveLimiter{algorithm: algorithm, min: min, max: max,
+		limit: float64(initial)}
+}
+
+// Acquire takes a slot for a request, if there is one.  If so, the slot
+// must be given back by calling the release function once the request
+// completes, with its round trip time, and whether it was dropped.  A
+// round trip time of 0 gives back the slot without counting the request,
+// such as when it never reached the service.
+func (a *AdaptiveLimiter) Acquire() (func(rtt time.Duration, dropped bool),
+	bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inflight >= int(a.limit) {
+		return nil, false
+	}
+	a.inflight++
+	inflight := a.inflight
+
+	var once sync.Once
+	return func(rtt time.Duration, dropped bool) {
+		once.Do(func() { a.release(rtt, inflight, dropped) })
+	}, true
+}
+
+func (a *AdaptiveLimiter) release(rtt time.Duration, inflight int,
+	dropped bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inflight--
+	if rtt <= 0 && !dropped {
+		return
+	}
+	limit := a.algorithm.Update(a.limit, rtt, inflight, dropped)
+	limit = math.Max(limit, float64(a.min))
+	if a.max > 0 {
+		limit = math.Min(limit, float64(a.max))
+	}
+	a.limit = limit
+}
+
+// Limit returns the current concurrency limit.
+func (a *AdaptiveLimiter) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return int(a.limit)
+}
+
+// Inflight returns the number of requests holding a slot.
+func (a *AdaptiveLimiter) Inflight() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.inflight
+}
@@ -0,0 +1,110 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+)
+
+// simulate drives the limiter with clients that always have requests
+// waiting, against a backend that answers in 10ms until more than its
+// capacity are in flight, and then slows down in proportion, as the
+// excess queue up inside it.  It returns the mean limit over the second
+// half of the rounds, once the limiter should have settled.
+func simulate(a *AdaptiveLimiter, capacity, rounds int) int {
+	base := 10 * time.Millisecond
+	sum := 0
+	for i := 0; i < rounds; i++ {
+		var releases []func(time.Duration, bool)
+		for {
+			release, ok := a.Acquire()
+			if !ok {
+				break
+			}
+			releases = append(releases, release)
+		}
+		rtt := base
+		if n := len(releases); n > capacity {
+			rtt = base * time.Duration(n) / time.Duration(capacity)
+		}
+		for _, release := range releases {
+			release(rtt, false)
+		}
+		if i >= rounds/2 {
+			sum += a.Limit()
+		}
+	}
+	return sum / (rounds - rounds/2)
+}
+
+// Test that the limit converges on the capacity of the backend, or a
+// little over it, as both algorithms tolerate some queueing, whether it
+// starts too low or too high, and follows it when it changes.
+func TestAdaptiveConvergence(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		algorithm func() Algorithm
+	}{
+		{"aimd", func() Algorithm {
+			return &AIMD{Threshold: 15 * time.Millisecond}
+		}},
+		{"gradient", func() Algorithm { return &Gradient{} }},
+	} {
+		for _, initial := range []int{5, 500} {
+			a := NewAdaptiveLimiter(tc.algorithm(), initial, 1, 1000)
+			if l := simulate(a, 40, 400); l < 30 || l > 80 {
+				t.Fatalf("%s from %d: expected a limit near 40, got %d",
+					tc.name, initial, l)
+			}
+			// The backend degrades.
+			if l := simulate(a, 10, 400); l < 7 || l > 25 {
+				t.Fatalf("%s from %d: expected a limit near 10, got %d",
+					tc.name, initial, l)
+			}
+			// And recovers.
+			if l := simulate(a, 40, 400); l < 30 || l > 80 {
+				t.Fatalf("%s from %d: expected a limit near 40 again, got %d",
+					tc.name, initial, l)
+			}
+			if n := a.Inflight(); n != 0 {
+				t.Fatalf("%s: %d slots not given back", tc.name, n)
+			}
+		}
+	}
+}
+
+func TestAdaptiveLimits(t *testing.T) {
+	a := NewAdaptiveLimiter(&AIMD{Threshold: time.Second}, 2, 2, 3)
+	r1, ok1 := a.Acquire()
+	r2, ok2 := a.Acquire()
+	if _, ok := a.Acquire(); !ok1 || !ok2 || ok {
+		t.Fatalf("expected 2 slots")
+	}
+
+	// Releasing twice only counts once.
+	r1(time.Millisecond, false)
+	r1(time.Millisecond, false)
+	r2(time.Millisecond, false)
+	if n := a.Inflight(); n != 0 {
+		t.Fatalf("expected none in flight, got %d", n)
+	}
+
+	// The limit grows while in use, up to the maximum.
+	for i := 0; i < 20; i++ {
+		r1, _ := a.Acquire()
+		r2, _ := a.Acquire()
+		r1(time.Millisecond, false)
+		r2(time.Millisecond, false)
+	}
+	if l := a.Limit(); l != 3 {
+		t.Fatalf("expected a limit of 3, got %d", l)
+	}
+
+	// Drops cut the limit back, down to the minimum.
+	for i := 0; i < 10; i++ {
+		release, _ := a.Acquire()
+		release(0, true)
+	}
+	if l := a.Limit(); l != 2 {
+		t.Fatalf("expected a limit of 2, got %d", l)
+	}
+}
@@ -0,0 +1,236 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BucketLimiter implements the Limiter interface without a token server.
+// Rather than dispensing tokens from a generator loop, it timestamps each
+// request and extrapolates how many tokens have accrued since the
+// previous one, capped at the burst size.
+//
+// The advantage over the PulseLimiter is that a single request may be
+// charged any number of tokens, which is what the formal Token Bucket
+// algorithm does when the units are bytes.  It also scales to rates,
+// such as bytes per second, that would be far too fine-grained for a
+// timer loop to keep up with.
+//
+// Requests that have to wait reserve their tokens up front, so the
+// token count may go negative.  Waiters are therefore served in the
+// order they arrived, and a request that could not be satisfied within
+// its timeout is turned away immediately instead of after waiting.
+type BucketLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   int
+	tokens  float64
+	last    time.Time
+	refills *refillHooks
+}
+
+// Ensure all interface methods are present.
+var (
+	_ Limiter        = (*BucketLimiter)(nil)
+	_ CostLimiter    = (*BucketLimiter)(nil)
+	_ RefillNotifier = (*BucketLimiter)(nil)
+	_ Stater         = (*BucketLimiter)(nil)
+	_ Refunder       = (*BucketLimiter)(nil)
+	_ Adjuster       = (*BucketLimiter)(nil)
+)
+
+// NewBucketLimiter creates a new interpolating Limiter.  The parameters
+// have the same meaning as for NewPulseLimiter, except that the bucket
+// starts out full.
+func NewBucketLimiter(items int, interval IntervalType,
+	burst int) (*BucketLimiter, error) {
+	if items <= 0 {
+		return nil, fmt.Errorf("'items' must be positive")
+	}
+	if burst <= 0 {
+		return nil, fmt.Errorf("'burst' must be positive")
+	}
+
+	dur := intervalTypeToDuration(interval)
+	b := BucketLimiter{}
+	b.rate = float64(items) / dur.Seconds()
+	b.burst = burst
+	b.tokens = float64(burst)
+	b.last = time.Now()
+	b.refills = &refillHooks{}
+	return &b, nil
+}
+
+// HasTokenServer indicates that the BucketLimiter does not use a
+// token server loop.
+func (b *BucketLimiter) HasTokenServer() bool {
+	return false
+}
+
+// ServeTokens returns immediately, as there is no token server.
+func (b *BucketLimiter) ServeTokens(ctx context.Context) {
+}
+
+// NotifyRefill registers a function to be called whenever tokens have
+// accrued in the bucket.  As tokens are computed lazily, this happens
+// when the next request arrives.
+func (b *BucketLimiter) NotifyRefill(fn func(wait time.Duration)) {
+	b.refills.add(fn)
+}
+
+// Burst returns the capacity of the bucket.
+func (b *BucketLimiter) Burst() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.burst
+}
+
+// State returns the current state of the bucket.
+func (b *BucketLimiter) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tokens := b.tokens
+	if elapsed := time.Since(b.last); elapsed > 0 {
+		tokens += elapsed.Seconds() * b.rate
+	}
+	if tokens > float64(b.burst) {
+		tokens = float64(b.burst)
+	}
+	return State{Tokens: tokens, Burst: b.burst, Rate: b.rate}
+}
+
+// Refund hands back n tokens, up to the capacity of the bucket.
+func (b *BucketLimiter) Refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+}
+
+// Adjust changes the rate and burst size of the bucket.  The tokens
+// accrued so far are kept, up to the new burst size.
+func (b *BucketLimiter) Adjust(rate float64, burst int) error {
+	if rate < 0 || burst < 0 {
+		return fmt.Errorf("'rate' and 'burst' must be positive")
+	}
+	b.mu.Lock()
+	refilled := b.advance(time.Now())
+	if rate > 0 {
+		b.rate = rate
+	}
+	if burst > 0 {
+		b.burst = burst
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.mu.Unlock()
+
+	if refilled > 0 {
+		b.refills.fire(refilled)
+	}
+	return nil
+}
+
+// AcquireToken attempts to acquire a token within the specified timeout.
+// Passing a 0 for the timeout means it will block "forever".
+func (b *BucketLimiter) AcquireToken(ctx context.Context,
+	timeout time.Duration) (bool, error) {
+	return b.AcquireTokens(ctx, 1, timeout)
+}
+
+// TryAcquireToken attempts to get a token, and fails if one is not
+// immediately available.
+func (b *BucketLimiter) TryAcquireToken(ctx context.Context) (bool, error) {
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("context canceled")
+	}
+	_, ok := b.reserve(1, 0)
+	return ok, nil
+}
+
+// AcquireTokens attempts to acquire n tokens within the specified
+// timeout, with 0 meaning no timeout.  Asking for more tokens than the
+// burst size fails with ErrExceedsBurst, as the request could never
+// be satisfied.
+func (b *BucketLimiter) AcquireTokens(ctx context.Context, n int,
+	timeout time.Duration) (bool, error) {
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("context canceled")
+	}
+	if n > b.Burst() {
+		return false, ErrExceedsBurst
+	}
+
+	maxWait := timeout
+	if timeout == 0 {
+		maxWait = -1
+	}
+	wait, ok := b.reserve(n, maxWait)
+	if !ok {
+		return false, nil
+	}
+	if wait == 0 {
+		return true, nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		// Hand back the reservation so it isn't lost to others.
+		b.Refund(n)
+		return false, fmt.Errorf("context canceled")
+	case <-t.C:
+		return true, nil
+	}
+}
+
+// reserve takes n tokens from the bucket, and returns how long the
+// caller must wait until they are actually available.  If that would be
+// longer than maxWait, nothing is taken and false is returned.  A
+// negative maxWait means the caller is willing to wait indefinitely.
+func (b *BucketLimiter) reserve(n int, maxWait time.Duration) (
+	time.Duration, bool) {
+	b.mu.Lock()
+	now := time.Now()
+	refilled := b.advance(now)
+
+	var wait time.Duration
+	ok := true
+	if missing := float64(n) - b.tokens; missing > 0 {
+		wait = time.Duration(missing / b.rate * float64(time.Second))
+	}
+	if maxWait >= 0 && wait > maxWait {
+		ok = false
+	} else {
+		b.tokens -= float64(n)
+	}
+	b.mu.Unlock()
+
+	if refilled > 0 {
+		b.refills.fire(refilled)
+	}
+	return wait, ok
+}
+
+// advance adds the tokens accrued since the last update, and returns
+// the elapsed time if any were added.  It must be called with the
+// lock held.
+func (b *BucketLimiter) advance(now time.Time) time.Duration {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	if elapsed <= 0 || b.tokens >= float64(b.burst) {
+		return 0
+	}
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	return elapsed
+}
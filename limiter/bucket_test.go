@@ -0,0 +1,155 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test that requests are charged by cost, and that tokens accrue
+// at the configured rate.
+func TestBucketAcquireTokens(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucketLimiter(10, Sec, 10)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v", err)
+	}
+
+	if res, err := b.AcquireTokens(ctx, 8, 0); err != nil || !res {
+		t.Fatalf("expected tokens, got %t, %v", res, err)
+	}
+	if res, _ := b.TryAcquireToken(ctx); !res {
+		t.Fatalf("expected a token to remain")
+	}
+
+	// Five more tokens take about 400ms to accrue.
+	if res, _ := b.AcquireTokens(ctx, 5, 100*time.Millisecond); res {
+		t.Fatalf("expected acquisition to time out")
+	}
+	start := time.Now()
+	if res, err := b.AcquireTokens(ctx, 5, time.Second); err != nil || !res {
+		t.Fatalf("expected tokens, got %t, %v", res, err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("tokens were available too soon: %v", d)
+	}
+
+	if _, err := b.AcquireTokens(ctx, 11, 0); err != ErrExceedsBurst {
+		t.Fatalf("expected ErrExceedsBurst, got %v", err)
+	}
+}
+
+// Test that refunds go back to the bucket, up to its capacity, even
+// through an observer.
+func TestRefund(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucketLimiter(1, Min, 5)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v", err)
+	}
+	l := Observe(b, "refund")
+	if res, err := l.AcquireTokens(ctx, 5, 0); err != nil || !res {
+		t.Fatalf("expected tokens, got %t, %v", res, err)
+	}
+	if !Refund(l, 3) {
+		t.Fatalf("expected the refund to be taken")
+	}
+	if st := b.State(); int(st.Tokens) != 3 {
+		t.Fatalf("expected 3 tokens, got %v", st.Tokens)
+	}
+	Refund(l, 10)
+	if st := b.State(); int(st.Tokens) != 5 {
+		t.Fatalf("expected a full bucket, got %v", st.Tokens)
+	}
+
+	// A canceled reservation is handed back up to the burst size, even
+	// if that shrank meanwhile.
+	b.AcquireTokens(ctx, 1, 0)
+	cctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.AcquireTokens(cctx, 5, 0)
+	}()
+	for b.State().Tokens >= 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := b.Adjust(0, 2); err != nil {
+		t.Fatalf("Adjust failed: %v", err)
+	}
+	cancel()
+	<-done
+	if st := b.State(); st.Tokens > 2 {
+		t.Fatalf("expected at most 2 tokens, got %v", st.Tokens)
+	}
+
+	p, err := NewPulseLimiter(1, Min, 2)
+	if err != nil {
+		t.Fatalf("Pulse creation failed: %v", err)
+	}
+	Refund(p, 5)
+	if st := p.State(); st.Tokens != 2 {
+		t.Fatalf("expected a full channel, got %v", st.Tokens)
+	}
+}
+
+// Test that refunds racing with the shutdown of a pulse limiter's token
+// server are dropped, rather than sent on the closed channel.
+func TestRefundWhileClosing(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		p, err := NewPulseLimiter(1000, Sec, 1)
+		if err != nil {
+			t.Fatalf("Pulse creation failed: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.ServeTokens(ctx)
+		}()
+		refunded := make(chan struct{})
+		go func() {
+			defer close(refunded)
+			for j := 0; j < 100; j++ {
+				p.TryAcquireToken(context.Background())
+				Refund(p, 1)
+			}
+		}()
+		cancel()
+		<-done
+		<-refunded
+		// Whatever tokens are left are drained before the channel shows
+		// as closed.
+		for n := 0; ; n++ {
+			res, err := p.TryAcquireToken(context.Background())
+			if err == ErrClosed {
+				break
+			}
+			if !res || n > p.Burst() {
+				t.Fatalf("expected the channel to be closed, got %t, %v",
+					res, err)
+			}
+		}
+	}
+}
+
+// Test that limiters are adjusted through their wrappers, and that a
+// bucket keeps its tokens, up to the new burst size.
+func TestAdjust(t *testing.T) {
+	b, _ := NewBucketLimiter(10, Sec, 10)
+	l := Observe(b, "k", ObserverFuncs{})
+	if err := Adjust(l, 100, 4); err != nil {
+		t.Fatalf("Adjust failed: %v", err)
+	}
+	if st := b.State(); st.Rate != 100 || st.Burst != 4 || st.Tokens != 4 {
+		t.Fatalf("unexpected state %+v", st)
+	}
+
+	p, _ := NewPulseLimiter(1, Sec, 2)
+	if err := Adjust(p, 10, 3); err != ErrFixedBurst {
+		t.Fatalf("expected the burst to be fixed, got %v", err)
+	}
+	if err := Adjust(p, 10, 2); err != nil || p.State().Rate != 10 {
+		t.Fatalf("expected the rate to change, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ package limiter
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
@@ -35,6 +36,149 @@ type Limiter interface {
 	ServeTokens(ctx context.Context)
 }
 
+// A CostLimiter is a Limiter that can charge several tokens for a
+// single unit of work, such as a request that is weighted by its
+// size in bytes.
+type CostLimiter interface {
+	Limiter
+	AcquireTokens(ctx context.Context, n int, timeout time.Duration) (bool,
+		error)
+	Burst() int
+}
+
+// State is a snapshot of a limiter's bucket.  The tokens may be
+// fractional for limiters that interpolate, and negative if waiting
+// requests have already reserved tokens that haven't yet accrued.
+type State struct {
+	Tokens float64 `json:"tokens"`
+	Burst  int     `json:"burst"`
+	Rate   float64 `json:"rate"` // tokens per second
+}
+
+// A Stater is a Limiter that can report the state of its bucket.
+type Stater interface {
+	State() State
+}
+
+// StateOf returns the state of the limiter's bucket, looking through
+// any wrappers such as an ObservedLimiter.  It returns false if the
+// limiter can't report its state.
+func StateOf(l Limiter) (State, bool) {
+	for {
+		switch v := l.(type) {
+		case Stater:
+			return v.State(), true
+		case interface{ Unwrap() Limiter }:
+			l = v.Unwrap()
+		default:
+			return State{}, false
+		}
+	}
+}
+
+// A Refunder is a Limiter that can take back tokens that were acquired
+// but not used after all, such as those of a request that was never
+// forwarded.
+type Refunder interface {
+	Refund(n int)
+}
+
+// Refund hands n tokens back to the limiter, looking through any
+// wrappers such as an ObservedLimiter.  It returns false if the limiter
+// doesn't take refunds.
+func Refund(l Limiter, n int) bool {
+	for {
+		switch v := l.(type) {
+		case Refunder:
+			v.Refund(n)
+			return true
+		case interface{ Unwrap() Limiter }:
+			l = v.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// An Adjuster is a Limiter whose rate, in tokens per second, and burst
+// size can be changed while it is in use.  A value of 0 keeps the
+// current one.
+type Adjuster interface {
+	Adjust(rate float64, burst int) error
+}
+
+// ErrNotAdjustable is returned by Adjust for limiters that can't be
+// changed while in use.
+var ErrNotAdjustable = errors.New("limiter can't be adjusted")
+
+// ErrFixedBurst is returned by Adjust for limiters whose burst size is
+// fixed when they're created.
+var ErrFixedBurst = errors.New("burst size can't be changed")
+
+// Adjust changes the rate and burst size of the limiter, looking through
+// any wrappers such as an ObservedLimiter, as per Adjuster.
+func Adjust(l Limiter, rate float64, burst int) error {
+	for {
+		switch v := l.(type) {
+		case Adjuster:
+			return v.Adjust(rate, burst)
+		case interface{ Unwrap() Limiter }:
+			l = v.Unwrap()
+		default:
+			return ErrNotAdjustable
+		}
+	}
+}
+
+// ErrClosed is returned to requests waiting on a limiter whose token
+// server has stopped, such as one evicted from a Registry, or replaced on
+// a reload, while they waited.  Such requests can't get a token from it,
+// but haven't done anything wrong, so they should be treated as turned
+// away rather than as failed.
+var ErrClosed = errors.New("limiter closed")
+
+// ErrExceedsBurst is returned when more tokens are requested at once than
+// the bucket can ever hold.
+var ErrExceedsBurst = errors.New("request exceeds burst size")
+
+// AcquireTokens acquires n tokens from any Limiter within the timeout,
+// where 0 means no timeout.  CostLimiters charge the tokens in one go.
+// For other limiters, the tokens are acquired one at a time, and those
+// already taken are lost if the timeout expires part way through.
+func AcquireTokens(ctx context.Context, l Limiter, n int,
+	timeout time.Duration) (bool, error) {
+	if cl, ok := l.(CostLimiter); ok {
+		return cl.AcquireTokens(ctx, n, timeout)
+	}
+	if b := Burst(l); b > 0 && n > b {
+		return false, ErrExceedsBurst
+	}
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		remaining := timeout
+		if timeout != 0 {
+			remaining -= time.Since(start)
+			if remaining <= 0 {
+				return false, nil
+			}
+		}
+		if res, err := l.AcquireToken(ctx, remaining); err != nil || !res {
+			return res, err
+		}
+	}
+	return true, nil
+}
+
+// Burst returns the capacity of the limiter's bucket, or 0 if the
+// limiter doesn't say.
+func Burst(l Limiter) int {
+	if b, ok := l.(interface{ Burst() int }); ok {
+		return b.Burst()
+	}
+	return 0
+}
+
 func intervalTypeToDuration(t IntervalType) time.Duration {
 	var dur time.Duration
 	switch t {
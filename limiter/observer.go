@@ -0,0 +1,202 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// An Observer is notified of every decision a Limiter makes, so that
+// metrics, audit logging and alerting can be wired in from outside the
+// package.  Each callback receives the key the limiter was registered
+// under and the time spent waiting for the outcome.  Callbacks are
+// invoked synchronously on the path of the request, so they should
+// return quickly.
+type Observer interface {
+	// OnGrant is called when a token was acquired.
+	OnGrant(key string, wait time.Duration)
+
+	// OnDeny is called when a non-blocking acquisition found no token.
+	OnDeny(key string, wait time.Duration)
+
+	// OnTimeout is called when a blocking acquisition gave up waiting.
+	OnTimeout(key string, wait time.Duration)
+
+	// OnCancel is called when the acquisition was abandoned because the
+	// context was canceled or the limiter was shut down.
+	OnCancel(key string, wait time.Duration)
+
+	// OnRefill is called when a token is added to the bucket.  The wait
+	// is the time since the previous token was added.
+	OnRefill(key string, wait time.Duration)
+}
+
+// ObserverFuncs is an Observer built from optional functions, which is
+// handy when only some of the events are of interest.  Nil functions
+// are simply skipped.
+type ObserverFuncs struct {
+	Grant   func(key string, wait time.Duration)
+	Deny    func(key string, wait time.Duration)
+	Timeout func(key string, wait time.Duration)
+	Cancel  func(key string, wait time.Duration)
+	Refill  func(key string, wait time.Duration)
+}
+
+// Ensure all interface methods are present.
+var (
+	_ Observer    = ObserverFuncs{}
+	_ CostLimiter = (*ObservedLimiter)(nil)
+)
+
+// OnGrant implements the Observer interface.
+func (o ObserverFuncs) OnGrant(key string, wait time.Duration) {
+	if o.Grant != nil {
+		o.Grant(key, wait)
+	}
+}
+
+// OnDeny implements the Observer interface.
+func (o ObserverFuncs) OnDeny(key string, wait time.Duration) {
+	if o.Deny != nil {
+		o.Deny(key, wait)
+	}
+}
+
+// OnTimeout implements the Observer interface.
+func (o ObserverFuncs) OnTimeout(key string, wait time.Duration) {
+	if o.Timeout != nil {
+		o.Timeout(key, wait)
+	}
+}
+
+// OnCancel implements the Observer interface.
+func (o ObserverFuncs) OnCancel(key string, wait time.Duration) {
+	if o.Cancel != nil {
+		o.Cancel(key, wait)
+	}
+}
+
+// OnRefill implements the Observer interface.
+func (o ObserverFuncs) OnRefill(key string, wait time.Duration) {
+	if o.Refill != nil {
+		o.Refill(key, wait)
+	}
+}
+
+// A RefillNotifier is a Limiter that can report when it adds tokens to
+// its bucket.  Limiters that have a token server loop should implement
+// it, so that refills reach any observers attached to them.
+type RefillNotifier interface {
+	NotifyRefill(fn func(wait time.Duration))
+}
+
+// refillHooks is the list of refill callbacks held by a limiter.  It is
+// kept behind a pointer so that copies of a limiter share it.
+type refillHooks struct {
+	mu  sync.Mutex
+	fns []func(time.Duration)
+}
+
+func (h *refillHooks) add(fn func(time.Duration)) {
+	h.mu.Lock()
+	h.fns = append(h.fns, fn)
+	h.mu.Unlock()
+}
+
+func (h *refillHooks) fire(wait time.Duration) {
+	h.mu.Lock()
+	fns := h.fns
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn(wait)
+	}
+}
+
+// ObservedLimiter wraps any Limiter and reports the outcome of each
+// token acquisition to a set of observers.  It otherwise behaves exactly
+// like the limiter it wraps.
+type ObservedLimiter struct {
+	limiter   Limiter
+	key       string
+	observers []Observer
+}
+
+// Observe wraps the limiter so that its decisions are reported to the
+// observers under the given key.  If the limiter is a RefillNotifier,
+// the observers are told about refills as well.
+func Observe(l Limiter, key string, obs ...Observer) *ObservedLimiter {
+	ol := &ObservedLimiter{limiter: l, key: key, observers: obs}
+	if rn, ok := l.(RefillNotifier); ok {
+		rn.NotifyRefill(func(wait time.Duration) {
+			for _, o := range ol.observers {
+				o.OnRefill(key, wait)
+			}
+		})
+	}
+	return ol
+}
+
+// Unwrap returns the limiter being observed.
+func (ol *ObservedLimiter) Unwrap() Limiter {
+	return ol.limiter
+}
+
+// HasTokenServer reports whether the wrapped limiter has a token server.
+func (ol *ObservedLimiter) HasTokenServer() bool {
+	return ol.limiter.HasTokenServer()
+}
+
+// ServeTokens runs the token server of the wrapped limiter.
+func (ol *ObservedLimiter) ServeTokens(ctx context.Context) {
+	ol.limiter.ServeTokens(ctx)
+}
+
+// AcquireToken acquires a token from the wrapped limiter and reports
+// a grant, timeout or cancellation.
+func (ol *ObservedLimiter) AcquireToken(ctx context.Context,
+	timeout time.Duration) (bool, error) {
+	start := time.Now()
+	res, err := ol.limiter.AcquireToken(ctx, timeout)
+	ol.report(res, err, time.Since(start), Observer.OnTimeout)
+	return res, err
+}
+
+// AcquireTokens acquires n tokens from the wrapped limiter, as per the
+// package-level AcquireTokens, and reports the outcome once.
+func (ol *ObservedLimiter) AcquireTokens(ctx context.Context, n int,
+	timeout time.Duration) (bool, error) {
+	start := time.Now()
+	res, err := AcquireTokens(ctx, ol.limiter, n, timeout)
+	ol.report(res, err, time.Since(start), Observer.OnTimeout)
+	return res, err
+}
+
+// Burst returns the capacity of the wrapped limiter's bucket.
+func (ol *ObservedLimiter) Burst() int {
+	return Burst(ol.limiter)
+}
+
+// TryAcquireToken attempts to get a token from the wrapped limiter
+// without blocking, and reports a grant, denial or cancellation.
+func (ol *ObservedLimiter) TryAcquireToken(ctx context.Context) (bool, error) {
+	start := time.Now()
+	res, err := ol.limiter.TryAcquireToken(ctx)
+	ol.report(res, err, time.Since(start), Observer.OnDeny)
+	return res, err
+}
+
+// report dispatches the outcome of an acquisition.  The failed function
+// is the callback used when no token was available.
+func (ol *ObservedLimiter) report(res bool, err error, wait time.Duration,
+	failed func(Observer, string, time.Duration)) {
+	for _, o := range ol.observers {
+		switch {
+		case err != nil:
+			o.OnCancel(ol.key, wait)
+		case !res:
+			failed(o, ol.key, wait)
+		default:
+			o.OnGrant(ol.key, wait)
+		}
+	}
+}
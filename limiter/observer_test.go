@@ -0,0 +1,68 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that each kind of decision reaches the observer with its key.
+func TestObserver(t *testing.T) {
+	var grant, deny, timeout, cancel, refill int64
+	obs := ObserverFuncs{
+		Grant:   func(string, time.Duration) { atomic.AddInt64(&grant, 1) },
+		Deny:    func(string, time.Duration) { atomic.AddInt64(&deny, 1) },
+		Timeout: func(string, time.Duration) { atomic.AddInt64(&timeout, 1) },
+		Cancel:  func(string, time.Duration) { atomic.AddInt64(&cancel, 1) },
+		Refill: func(key string, wait time.Duration) {
+			if key != "events" {
+				t.Errorf("unexpected key: %s", key)
+			}
+			atomic.AddInt64(&refill, 1)
+		},
+	}
+
+	p, err := NewPulseLimiter(2, Sec, 1)
+	if err != nil {
+		t.Fatalf("Pulser creation failed: %v", err)
+	}
+	ol := Observe(p, "events", obs)
+
+	ctx, stop := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ol.ServeTokens(ctx)
+	}()
+
+	// The first token is there right away, the next one is half a
+	// second off.
+	if res, err := ol.AcquireToken(ctx, time.Second); err != nil || !res {
+		t.Fatalf("expected token, got %t, %v", res, err)
+	}
+	if res, _ := ol.TryAcquireToken(ctx); res {
+		t.Fatalf("expected no token to be available")
+	}
+	if res, _ := ol.AcquireToken(ctx, 10*time.Millisecond); res {
+		t.Fatalf("expected acquisition to time out")
+	}
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if _, err := ol.AcquireToken(cctx, time.Second); err == nil {
+		t.Fatalf("expected canceled acquisition to fail")
+	}
+
+	stop()
+	wg.Wait()
+	if grant != 1 || deny != 1 || timeout != 1 || cancel != 1 {
+		t.Fatalf("unexpected counts: grant: %d, deny: %d, timeout: %d, "+
+			"cancel: %d", grant, deny, timeout, cancel)
+	}
+	if refill < 1 {
+		t.Fatalf("expected at least one refill, got %d", refill)
+	}
+}
@@ -3,7 +3,8 @@ package limiter
 import (
 	"context"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,13 +30,26 @@ import (
 // store the current token count, as the size and blocking nature of the
 // channel limits the tokens appropriately.
 type PulseLimiter struct {
-	interval time.Duration
+	interval *atomic.Int64 // shared by the copies of the limiter
 	tokens   chan struct{}
+	refills  *refillHooks
+	closing  *pulseClosing
+}
+
+// pulseClosing keeps refunds from sending on the channel once the token
+// server has closed it.
+type pulseClosing struct {
+	mu     sync.Mutex
+	closed bool
 }
 
 // Ensure all interface methods are present.
 var (
-	_ Limiter = (*PulseLimiter)(nil)
+	_ Limiter        = (*PulseLimiter)(nil)
+	_ RefillNotifier = (*PulseLimiter)(nil)
+	_ Stater         = (*PulseLimiter)(nil)
+	_ Refunder       = (*PulseLimiter)(nil)
+	_ Adjuster       = (*PulseLimiter)(nil)
 )
 
 // NewPulseLimiter creates a new timer-based Limiter.  The input
@@ -55,17 +69,71 @@ func NewPulseLimiter(items int, interval IntervalType,
 
 	dur := intervalTypeToDuration(interval)
 	p := PulseLimiter{}
-	p.interval = time.Duration(dur.Nanoseconds() / int64(items))
+	p.interval = &atomic.Int64{}
+	p.interval.Store(dur.Nanoseconds() / int64(items))
 	p.tokens = make(chan struct{}, burst)
+	p.refills = &refillHooks{}
+	p.closing = &pulseClosing{}
 	return &p, nil
 }
 
+// NotifyRefill registers a function to be called each time the token
+// server adds a token to the bucket.
+func (p PulseLimiter) NotifyRefill(fn func(wait time.Duration)) {
+	p.refills.add(fn)
+}
+
 // HasTokenServer indicates that the PulseLimiter does use a
 // token server loop.
 func (p PulseLimiter) HasTokenServer() bool {
 	return true
 }
 
+// Burst returns the capacity of the bucket.
+func (p PulseLimiter) Burst() int {
+	return cap(p.tokens)
+}
+
+// State returns the current state of the bucket.
+func (p PulseLimiter) State() State {
+	return State{Tokens: float64(len(p.tokens)), Burst: cap(p.tokens),
+		Rate: float64(time.Second) / float64(p.interval.Load())}
+}
+
+// Refund puts n tokens back in the channel, as far as there is room.
+// Refunds that arrive after the token server has closed the channel
+// are dropped.
+func (p PulseLimiter) Refund(n int) {
+	p.closing.mu.Lock()
+	defer p.closing.mu.Unlock()
+	if p.closing.closed {
+		return
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case p.tokens <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// Adjust changes the rate at which tokens are dispensed, from the next
+// one on.  The burst is the capacity of the channel, and so can't be
+// changed, other than to its current value.
+func (p PulseLimiter) Adjust(rate float64, burst int) error {
+	if burst != 0 && burst != cap(p.tokens) {
+		return ErrFixedBurst
+	}
+	if rate < 0 {
+		return fmt.Errorf("'rate' must be positive")
+	}
+	if rate > 0 {
+		p.interval.Store(int64(float64(time.Second) / rate))
+	}
+	return nil
+}
+
 // ServeTokens is the timer-driven token creator.  It is a
 // blocking call that would likely be invoked from a goroutine.
 func (p PulseLimiter) ServeTokens(ctx context.Context) {
@@ -75,6 +143,7 @@ func (p PulseLimiter) ServeTokens(ctx context.Context) {
 	// to help us if we misue it here.
 	var sender chan<- struct{} = p.tokens
 
+	last := time.Now()
 Loop:
 	for {
 		// If we need to finish, clean up.  Otherwise, try to add
@@ -86,17 +155,36 @@ Loop:
 		// comes around, the ctx.Done() will get read in the select.
 		select {
 		case <-ctx.Done():
-			log.Printf("Limiter cleanup successful!\n")
-			close(sender)
+			p.close(sender)
 			break Loop
 		case sender <- struct{}{}:
+			now := time.Now()
+			p.refills.fire(now.Sub(last))
+			last = now
 		}
 
-		// Sleep to regulate the rate.
-		time.Sleep(p.interval)
+		// Sleep to regulate the rate, unless told to finish, so that
+		// waiters are let go right away.
+		t := time.NewTimer(time.Duration(p.interval.Load()))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			p.close(sender)
+			break Loop
+		case <-t.C:
+		}
 	}
 }
 
+// close closes the channel, so that waiters are let go, once no refund
+// is under way.
+func (p PulseLimiter) close(sender chan<- struct{}) {
+	p.closing.mu.Lock()
+	defer p.closing.mu.Unlock()
+	p.closing.closed = true
+	close(sender)
+}
+
 // AcquireToken attempts to acquire a token for the request within the
 // specified timeout.  It returns a boolean specifying whether it
 // successfully acquired the token.  Passing a 0 (or zero value) for
@@ -121,7 +209,7 @@ func (p PulseLimiter) AcquireToken(ctx context.Context,
 		return false, nil
 	case _, ok := <-p.tokens:
 		if !ok {
-			return false, fmt.Errorf("channel closed")
+			return false, ErrClosed
 		}
 		return true, nil
 	}
@@ -136,7 +224,7 @@ func (p PulseLimiter) TryAcquireToken(ctx context.Context) (bool, error) {
 		return false, fmt.Errorf("context canceled")
 	case _, ok := <-p.tokens:
 		if !ok {
-			return false, fmt.Errorf("channel closed")
+			return false, ErrClosed
 		}
 		return true, nil
 	default:
@@ -0,0 +1,361 @@
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Discipline determines which waiting request is served next by a
+// QueuedLimiter.
+type Discipline int
+
+// Discipline constants.  FIFO serves waiters in the order they arrived.
+// LIFO serves the newest waiter first, as it is the one most likely to
+// still have a client waiting for it.  AdaptiveLIFO is FIFO as long as
+// the oldest waiter has waited less than the target delay, and switches
+// to LIFO under overload.  CoDel is FIFO, but once waiters have spent
+// longer than the target in the queue for a whole interval, it starts
+// turning the oldest ones away, at an increasing rate, until the delay
+// comes back down, as per the Controlled Delay algorithm.
+const (
+	FIFO Discipline = iota
+	LIFO
+	AdaptiveLIFO
+	CoDel
+)
+
+// defaultQueueTarget is the target delay if none is given.  CoDel's
+// interval is a multiple of the target, as in the original algorithm.
+const (
+	defaultQueueTarget = 100 * time.Millisecond
+	codelIntervals     = 20
+)
+
+// QueuedLimiter puts a bound on the number of requests waiting for
+// tokens from another Limiter.  Requests that can get their tokens right
+// away do so, but the others join a queue, and once it holds the maximum
+// number of waiters, further requests are turned away immediately rather
+// than each parking a goroutine until its timeout.  The waiters are
+// served one at a time, in the order given by the queue discipline, by a
+// dispatcher that runs as the limiter's token server.
+type QueuedLimiter struct {
+	limiter    Limiter
+	maxWaiters int
+	discipline Discipline
+	target     time.Duration
+
+	mu      sync.Mutex
+	waiters *list.List // of *waiter, oldest at the front
+	active  bool       // a waiter is being dispatched
+	notify  chan struct{}
+
+	// CoDel state.
+	dropping  bool
+	firstOver time.Time
+	nextDrop  time.Time
+	drops     int
+}
+
+// Ensure all interface methods are present.
+var (
+	_ Limiter     = (*QueuedLimiter)(nil)
+	_ CostLimiter = (*QueuedLimiter)(nil)
+)
+
+// The states of a waiter.
+const (
+	waiterQueued = iota
+	waiterDispatching
+	waiterAbandoned
+	waiterDone
+)
+
+type waiter struct {
+	n        int
+	enqueued time.Time
+	state    int
+	elem     *list.Element
+	ctx      context.Context // set once dispatched
+	cancel   context.CancelFunc
+	result   chan waitResult
+}
+
+type waitResult struct {
+	ok  bool
+	err error
+}
+
+// NewQueue wraps a limiter with a queue of at most maxWaiters waiting
+// requests, with 0 meaning no bound.  The target is the queueing delay
+// used by the AdaptiveLIFO and CoDel disciplines, with 0 meaning 100ms.
+func NewQueue(l Limiter, maxWaiters int, discipline Discipline,
+	target time.Duration) *QueuedLimiter {
+	if target <= 0 {
+		target = defaultQueueTarget
+	}
+	return &QueuedLimiter{limiter: l, maxWaiters: maxWaiters,
+		discipline: discipline, target: target, waiters: list.New(),
+		notify: make(chan struct{}, 1)}
+}
+
+// Unwrap returns the underlying limiter.
+func (q *QueuedLimiter) Unwrap() Limiter {
+	return q.limiter
+}
+
+// HasTokenServer indicates that the dispatcher must be run.
+func (q *QueuedLimiter) HasTokenServer() bool {
+	return true
+}
+
+// ServeTokens runs the dispatcher, along with the token server of the
+// underlying limiter, if it has one.  It is a blocking call that would
+// likely be invoked from a goroutine.
+func (q *QueuedLimiter) ServeTokens(ctx context.Context) {
+	var wg sync.WaitGroup
+	if q.limiter.HasTokenServer() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.limiter.ServeTokens(ctx)
+		}()
+	}
+	q.dispatch(ctx)
+	wg.Wait()
+}
+
+// Burst returns the burst size of the underlying limiter.
+func (q *QueuedLimiter) Burst() int {
+	return Burst(q.limiter)
+}
+
+// Waiting returns the number of requests in the queue.
+func (q *QueuedLimiter) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiters.Len()
+}
+
+// AcquireToken attempts to acquire a token within the specified timeout.
+// Passing a 0 for the timeout means it will block "forever".
+func (q *QueuedLimiter) AcquireToken(ctx context.Context,
+	timeout time.Duration) (bool, error) {
+	return q.AcquireTokens(ctx, 1, timeout)
+}
+
+// TryAcquireToken attempts to get a token, and fails if one is not
+// immediately available, or others are already waiting for one.
+func (q *QueuedLimiter) TryAcquireToken(ctx context.Context) (bool, error) {
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("context canceled")
+	}
+	q.mu.Lock()
+	idle := q.waiters.Len() == 0 && !q.active
+	q.mu.Unlock()
+	if !idle {
+		return false, nil
+	}
+	return q.limiter.TryAcquireToken(ctx)
+}
+
+// AcquireTokens attempts to acquire n tokens within the specified
+// timeout, with 0 meaning no timeout.  If the queue is full, it fails
+// straight away.
+func (q *QueuedLimiter) AcquireTokens(ctx context.Context, n int,
+	timeout time.Duration) (bool, error) {
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("context canceled")
+	}
+	if b := Burst(q.limiter); b > 0 && n > b {
+		return false, ErrExceedsBurst
+	}
+
+	q.mu.Lock()
+	if q.waiters.Len() == 0 && !q.active {
+		q.mu.Unlock()
+		if q.tryAcquire(ctx, n) {
+			return true, nil
+		}
+		q.mu.Lock()
+	}
+	if q.maxWaiters > 0 && q.waiters.Len() >= q.maxWaiters {
+		q.mu.Unlock()
+		return false, nil
+	}
+	w := &waiter{n: n, enqueued: time.Now(), result: make(chan waitResult, 1)}
+	w.elem = q.waiters.PushBack(w)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	var expired <-chan time.Time
+	if timeout != 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case r := <-w.result:
+		return r.ok, r.err
+	case <-ctx.Done():
+		if r, ok := q.abandon(w); ok {
+			return r.ok, r.err
+		}
+		return false, fmt.Errorf("context canceled")
+	case <-expired:
+		if r, ok := q.abandon(w); ok {
+			return r.ok, r.err
+		}
+		return false, nil
+	}
+}
+
+// tryAcquire takes n tokens if they are available right away.
+func (q *QueuedLimiter) tryAcquire(ctx context.Context, n int) bool {
+	if n == 1 {
+		ok, err := q.limiter.TryAcquireToken(ctx)
+		return ok && err == nil
+	}
+	if cl, ok := q.limiter.(CostLimiter); ok {
+		// The bucket turns away requests it can't satisfy in time.
+		ok, err := cl.AcquireTokens(ctx, n, time.Nanosecond)
+		return ok && err == nil
+	}
+	return false
+}
+
+// abandon withdraws a waiter that gave up.  If it had already been
+// served, its result is returned instead.
+func (q *QueuedLimiter) abandon(w *waiter) (waitResult, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch w.state {
+	case waiterQueued:
+		q.waiters.Remove(w.elem)
+	case waiterDispatching:
+		w.state = waiterAbandoned
+		w.cancel()
+	case waiterDone:
+		return <-w.result, true
+	}
+	return waitResult{}, false
+}
+
+// dispatch serves the waiters one at a time, until the context is
+// canceled.
+func (q *QueuedLimiter) dispatch(ctx context.Context) {
+	for {
+		w := q.next(ctx)
+		if w == nil {
+			break
+		}
+
+		ok, err := AcquireTokens(w.ctx, q.limiter, w.n, 0)
+		w.cancel()
+
+		q.mu.Lock()
+		q.active = false
+		if w.state == waiterAbandoned {
+			if ok {
+				Refund(q.limiter, w.n)
+			}
+		} else {
+			w.state = waiterDone
+			w.result <- waitResult{ok: ok, err: err}
+		}
+		q.mu.Unlock()
+	}
+
+	// Nobody is left to serve the remaining waiters.
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.waiters.Len() > 0 {
+		w := q.waiters.Remove(q.waiters.Front()).(*waiter)
+		w.state = waiterDone
+		w.result <- waitResult{err: fmt.Errorf("context canceled")}
+	}
+}
+
+// next waits for a waiter, and takes the one to serve next off the
+// queue, turning away any that CoDel drops.  It returns nil once the
+// context is canceled.
+func (q *QueuedLimiter) next(ctx context.Context) *waiter {
+	for {
+		q.mu.Lock()
+		if w := q.pick(time.Now()); w != nil {
+			w.ctx, w.cancel = context.WithCancel(ctx)
+			q.active = true
+			q.mu.Unlock()
+			return w
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.notify:
+		}
+	}
+}
+
+// pick removes the waiter to serve next from the queue.  It must be
+// called with the lock held.
+func (q *QueuedLimiter) pick(now time.Time) *waiter {
+	for q.waiters.Len() > 0 {
+		el := q.waiters.Front()
+		switch q.discipline {
+		case LIFO:
+			el = q.waiters.Back()
+		case AdaptiveLIFO:
+			if now.Sub(el.Value.(*waiter).enqueued) > q.target {
+				el = q.waiters.Back()
+			}
+		}
+		w := q.waiters.Remove(el).(*waiter)
+		if q.discipline == CoDel && q.codelDrop(w, now) {
+			w.state = waiterDone
+			w.result <- waitResult{}
+			continue
+		}
+		w.state = waiterDispatching
+		return w
+	}
+	return nil
+}
+
+// codelDrop decides whether to drop a waiter, as per CoDel.  It must be
+// called with the lock held.
+func (q *QueuedLimiter) codelDrop(w *waiter, now time.Time) bool {
+	interval := codelIntervals * q.target
+	if now.Sub(w.enqueued) < q.target {
+		q.firstOver = time.Time{}
+		q.dropping = false
+		return false
+	}
+	if q.firstOver.IsZero() {
+		q.firstOver = now.Add(interval)
+		return false
+	}
+	if q.dropping {
+		if now.Before(q.nextDrop) {
+			return false
+		}
+		q.drops++
+	} else {
+		if now.Before(q.firstOver) {
+			return false
+		}
+		q.dropping = true
+		q.drops = 1
+	}
+	// Drop ever more often while the delay stays high.
+	q.nextDrop = now.Add(time.Duration(float64(interval) /
+		math.Sqrt(float64(q.drops))))
+	return true
+}
@@ -0,0 +1,169 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that waiters beyond the bound are turned away immediately, and
+// that the others are served as tokens accrue, both before and while the
+// dispatcher is serving one of them.
+func TestQueueBound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b, err := NewBucketLimiter(20, Sec, 1)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v", err)
+	}
+	q := NewQueue(b, 1, FIFO, 0)
+
+	if res, _ := q.AcquireToken(ctx, time.Second); !res {
+		t.Fatalf("expected the first token right away")
+	}
+
+	// Fill the queue before the dispatcher starts.
+	result := make(chan bool, 1)
+	go func() {
+		res, _ := q.AcquireToken(ctx, time.Second)
+		result <- res
+	}()
+	for q.Waiting() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if res, err := q.AcquireToken(ctx, time.Second); res || err != nil {
+		t.Fatalf("expected rejection, got %t, %v", res, err)
+	}
+	if d := time.Since(start); d > 20*time.Millisecond {
+		t.Fatalf("rejection took %v", d)
+	}
+
+	go q.ServeTokens(ctx)
+	if !<-result {
+		t.Fatalf("expected the waiter to be served")
+	}
+
+	// A waiter being served no longer counts against the bound, so one
+	// more can wait behind it.
+	var wg sync.WaitGroup
+	results := make(chan bool, 2)
+	acquire := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, _ := q.AcquireToken(ctx, time.Second)
+			results <- res
+		}()
+	}
+	dispatching := func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.active
+	}
+	acquire()
+	for !dispatching() {
+		time.Sleep(time.Millisecond)
+	}
+	acquire()
+	for q.Waiting() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if res, err := q.AcquireToken(ctx, time.Second); res || err != nil {
+		t.Fatalf("expected rejection, got %t, %v", res, err)
+	}
+
+	wg.Wait()
+	close(results)
+	for res := range results {
+		if !res {
+			t.Fatalf("expected the waiters to be served")
+		}
+	}
+}
+
+// Test the order in which the disciplines serve waiters.
+func TestQueueDiscipline(t *testing.T) {
+	for _, tc := range []struct {
+		discipline Discipline
+		want       []int
+	}{
+		{discipline: FIFO, want: []int{0, 1, 2}},
+		{discipline: LIFO, want: []int{2, 1, 0}},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		b, err := NewBucketLimiter(20, Sec, 1)
+		if err != nil {
+			t.Fatalf("Bucket creation failed: %v", err)
+		}
+		b.AcquireToken(ctx, 0)
+		q := NewQueue(b, 0, tc.discipline, 0)
+
+		// Queue the waiters before the dispatcher starts.
+		var mu sync.Mutex
+		var got []int
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if res, _ := q.AcquireToken(ctx, time.Second); res {
+					mu.Lock()
+					got = append(got, i)
+					mu.Unlock()
+				}
+			}(i)
+			for q.Waiting() <= i {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		go q.ServeTokens(ctx)
+		wg.Wait()
+		cancel()
+
+		if len(got) != 3 || got[0] != tc.want[0] || got[1] != tc.want[1] ||
+			got[2] != tc.want[2] {
+			t.Fatalf("discipline %d: expected %v, got %v", tc.discipline,
+				tc.want, got)
+		}
+	}
+}
+
+// Test that CoDel turns away waiters that have been queued too long.
+func TestQueueCoDel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b, err := NewBucketLimiter(1, Min, 1)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v", err)
+	}
+	b.AcquireToken(ctx, 0)
+	q := NewQueue(b, 0, CoDel, time.Millisecond)
+
+	now := time.Now()
+	stale := func() *waiter {
+		w := &waiter{n: 1, enqueued: now.Add(-time.Second),
+			result: make(chan waitResult, 1)}
+		w.elem = q.waiters.PushBack(w)
+		return w
+	}
+
+	// The first stale waiter starts the interval, and is served.
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w := stale()
+	if q.pick(now) != w {
+		t.Fatalf("expected the waiter to be served")
+	}
+
+	// Once the interval is over, stale waiters are dropped.
+	w = stale()
+	if got := q.pick(now.Add(100 * time.Millisecond)); got != nil {
+		t.Fatalf("expected the waiter to be dropped")
+	}
+	if r := <-w.result; r.ok || r.err != nil {
+		t.Fatalf("unexpected result: %+v", r)
+	}
+}
@@ -0,0 +1,278 @@
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Registry hands out a separate Limiter for each key, such as one per
+// client, so that no single client can consume the budget of the others.
+// Limiters are created on demand by a factory function, and are evicted
+// once they've been idle for longer than the TTL, or when the registry
+// grows beyond its maximum size, in which case the least recently used
+// one goes first.  An evicted key simply gets a fresh limiter the next
+// time it is seen.
+type Registry struct {
+	factory func(key string) (Limiter, error)
+	ttl     time.Duration
+	maxKeys int
+
+	mu      sync.Mutex
+	rate    float64 // adjustments to apply to new limiters
+	burst   int
+	ctx     context.Context
+	entries map[string]*list.Element
+	lru     *list.List // most recently used at the front
+
+	servers sync.WaitGroup // the token servers started by Run
+}
+
+type registryEntry struct {
+	key      string
+	limiter  Limiter
+	lastUsed time.Time
+	cancel   context.CancelFunc
+}
+
+// NewRegistry creates a registry that uses the factory to create the
+// limiter for a new key.  A ttl of 0 means idle limiters are kept, and
+// a maxKeys of 0 means there is no limit on the number of keys.
+func NewRegistry(factory func(key string) (Limiter, error),
+	ttl time.Duration, maxKeys int) *Registry {
+	return &Registry{factory: factory, ttl: ttl, maxKeys: maxKeys,
+		entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Get returns the limiter for the key, creating it if need be.
+func (r *Registry) Get(key string) (Limiter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := r.entries[key]; ok {
+		ent := el.Value.(*registryEntry)
+		ent.lastUsed = now
+		r.lru.MoveToFront(el)
+		return ent.limiter, nil
+	}
+
+	l, err := r.factory(key)
+	if err != nil {
+		return nil, err
+	}
+	if r.rate > 0 || r.burst > 0 {
+		// A limiter that starts out full still does once adjusted.
+		st, ok := StateOf(l)
+		full := ok && st.Tokens >= float64(st.Burst)
+		if err := Adjust(l, r.rate, r.burst); err != nil {
+			return nil, err
+		}
+		if full {
+			Refund(l, Burst(l))
+		}
+	}
+	ent := &registryEntry{key: key, limiter: l, lastUsed: now}
+	r.entries[key] = r.lru.PushFront(ent)
+	if r.ctx != nil {
+		r.serve(ent)
+	}
+	for r.maxKeys > 0 && r.lru.Len() > r.maxKeys {
+		r.remove(r.lru.Back())
+	}
+	return l, nil
+}
+
+// Delete discards the limiter for the key, so that it starts over with
+// a fresh one.  It returns false if there was no such key.
+func (r *Registry) Delete(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.entries[key]
+	if ok {
+		r.remove(el)
+	}
+	return ok
+}
+
+// Adjust changes the rate and burst size of the limiters in the
+// registry, as per the Adjuster interface, including those created
+// later on.  If the limiters can't be adjusted, it returns the error,
+// and nothing is changed.  Should one of them fail where the others
+// didn't, the rest are adjusted all the same, and the first such error
+// is returned.
+func (r *Registry) Adjust(rate float64, burst int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rate < 0 || burst < 0 {
+		return fmt.Errorf("'rate' and 'burst' must be positive")
+	}
+	var lims []Limiter
+	for el := r.lru.Front(); el != nil; el = el.Next() {
+		lims = append(lims, el.Value.(*registryEntry).limiter)
+	}
+	if len(lims) == 0 {
+		// Check that the limiters can be adjusted on one that isn't
+		// handed out.
+		l, err := r.factory("")
+		if err != nil {
+			return err
+		}
+		lims = append(lims, l)
+	}
+	// The limiters all come from the one factory, so if the first can be
+	// adjusted, so can the rest.
+	if err := Adjust(lims[0], rate, burst); err != nil {
+		return err
+	}
+	var failed error
+	for _, l := range lims[1:] {
+		if err := Adjust(l, rate, burst); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	if rate > 0 {
+		r.rate = rate
+	}
+	if burst > 0 {
+		r.burst = burst
+	}
+	return failed
+}
+
+// Limits returns the rate and burst size of the limiters in the
+// registry, as made by the factory and adjusted since, if they can
+// report their state.
+func (r *Registry) Limits() (rate float64, burst int, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var l Limiter
+	if el := r.lru.Front(); el != nil {
+		l = el.Value.(*registryEntry).limiter
+	} else {
+		// Ask one that isn't handed out.
+		var err error
+		if l, err = r.factory(""); err != nil {
+			return 0, 0, false
+		}
+		if r.rate > 0 || r.burst > 0 {
+			if err := Adjust(l, r.rate, r.burst); err != nil {
+				return 0, 0, false
+			}
+		}
+	}
+	st, ok := StateOf(l)
+	return st.Rate, st.Burst, ok
+}
+
+// Range calls the function for each key and its limiter, most recently
+// used first, until it returns false.  The registry isn't locked while
+// the function runs, so it may use the registry itself.
+func (r *Registry) Range(fn func(key string, l Limiter) bool) {
+	r.mu.Lock()
+	ents := make([]*registryEntry, 0, r.lru.Len())
+	for el := r.lru.Front(); el != nil; el = el.Next() {
+		ents = append(ents, el.Value.(*registryEntry))
+	}
+	r.mu.Unlock()
+
+	for _, ent := range ents {
+		if !fn(ent.key, ent.limiter) {
+			return
+		}
+	}
+}
+
+// Len returns the number of keys currently held.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lru.Len()
+}
+
+// Run runs the token servers of the limiters in the registry, including
+// those created later on, and periodically evicts idle limiters.  It is
+// a blocking call that would likely be invoked from a goroutine, and
+// returns once the context is canceled and the token servers have
+// stopped.
+func (r *Registry) Run(ctx context.Context) {
+	r.mu.Lock()
+	r.ctx = ctx
+	for el := r.lru.Front(); el != nil; el = el.Next() {
+		r.serve(el.Value.(*registryEntry))
+	}
+	r.mu.Unlock()
+
+	var tick <-chan time.Time
+	if r.ttl > 0 {
+		t := time.NewTicker(r.ttl / 2)
+		defer t.Stop()
+		tick = t.C
+	}
+
+Loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break Loop
+		case now := <-tick:
+			r.evictIdle(now)
+		}
+	}
+
+	r.mu.Lock()
+	for el := r.lru.Front(); el != nil; el = el.Next() {
+		if ent := el.Value.(*registryEntry); ent.cancel != nil {
+			ent.cancel()
+			ent.cancel = nil
+		}
+	}
+	r.ctx = nil
+	r.mu.Unlock()
+	r.servers.Wait()
+}
+
+// evictIdle removes the limiters that haven't been used within the TTL.
+func (r *Registry) evictIdle(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for el := r.lru.Back(); el != nil; {
+		ent := el.Value.(*registryEntry)
+		if now.Sub(ent.lastUsed) < r.ttl {
+			// Everything further forward was used more recently.
+			break
+		}
+		prev := el.Prev()
+		r.remove(el)
+		el = prev
+	}
+}
+
+// serve starts the token server for the entry, if it has one.  It must
+// be called with the lock held, while the registry is running.
+func (r *Registry) serve(ent *registryEntry) {
+	if !ent.limiter.HasTokenServer() || ent.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	ent.cancel = cancel
+	r.servers.Add(1)
+	go func() {
+		defer r.servers.Done()
+		ent.limiter.ServeTokens(ctx)
+	}()
+}
+
+// remove discards an entry and stops its token server.  It must be
+// called with the lock held.
+func (r *Registry) remove(el *list.Element) {
+	ent := r.lru.Remove(el).(*registryEntry)
+	delete(r.entries, ent.key)
+	if ent.cancel != nil {
+		ent.cancel()
+	}
+}
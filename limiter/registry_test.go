@@ -0,0 +1,90 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test that limiters are kept per key, and evicted by LRU and TTL.
+func TestRegistry(t *testing.T) {
+	created := 0
+	reg := NewRegistry(func(key string) (Limiter, error) {
+		created++
+		return NewPulseLimiter(10, Sec, 1)
+	}, 200*time.Millisecond, 2)
+
+	a, _ := reg.Get("a")
+	if again, _ := reg.Get("a"); again != a {
+		t.Fatalf("expected the same limiter for the same key")
+	}
+	reg.Get("b")
+	reg.Get("a")
+	reg.Get("c") // "b" is the least recently used, and goes.
+	if reg.Len() != 2 || created != 3 {
+		t.Fatalf("unexpected size %d, created %d", reg.Len(), created)
+	}
+	if again, _ := reg.Get("a"); again != a {
+		t.Fatalf("expected \"a\" to survive eviction")
+	}
+
+	// Limiters get their tokens once the registry runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reg.Run(ctx)
+		close(done)
+	}()
+	if res, err := a.AcquireToken(ctx, time.Second); err != nil || !res {
+		t.Fatalf("expected token, got %t, %v", res, err)
+	}
+
+	// Left idle, everything is evicted.
+	time.Sleep(500 * time.Millisecond)
+	if reg.Len() != 0 {
+		t.Fatalf("expected idle limiters to be evicted, %d left", reg.Len())
+	}
+	fresh, _ := reg.Get("a")
+	if fresh == a {
+		t.Fatalf("expected a fresh limiter after eviction")
+	}
+
+	// Run returns once the token servers have stopped, and closed their
+	// channels.
+	cancel()
+	<-done
+	for n := 0; ; n++ {
+		res, err := fresh.TryAcquireToken(context.Background())
+		if err == ErrClosed {
+			break
+		}
+		if !res || n > 1 {
+			t.Fatalf("expected the token server to have stopped")
+		}
+	}
+}
+
+// Test that adjustments reach every limiter, and that a failure is
+// reported even if it isn't the first limiter's.
+func TestRegistryAdjust(t *testing.T) {
+	reg := NewRegistry(func(key string) (Limiter, error) {
+		if key == "pulse" {
+			return NewPulseLimiter(10, Sec, 1)
+		}
+		return NewBucketLimiter(10, Sec, 1)
+	}, 0, 0)
+	reg.Get("pulse")
+	b, _ := reg.Get("bucket")
+	if err := reg.Adjust(20, 2); err != ErrFixedBurst {
+		t.Fatalf("expected ErrFixedBurst, got %v", err)
+	}
+	if st, _ := StateOf(b); st.Rate != 20 || st.Burst != 2 {
+		t.Fatalf("expected the bucket to be adjusted, got %+v", st)
+	}
+	if err := reg.Adjust(30, 0); err != nil {
+		t.Fatalf("Adjust failed: %v", err)
+	}
+	if l, _ := reg.Get("new"); l.(*BucketLimiter).State().Rate != 30 {
+		t.Fatalf("expected new limiters to be adjusted")
+	}
+}
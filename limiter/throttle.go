@@ -0,0 +1,129 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrThrottled is returned by the throttled readers and writers when
+// the limiter refuses to hand out the tokens for a transfer.
+var ErrThrottled = errors.New("transfer throttled")
+
+// The throttled wrappers below pace a byte stream with a Limiter, at one
+// token per byte.  They work with any Limiter, but a CostLimiter such as
+// the BucketLimiter is a much better fit, as it charges a whole chunk in
+// one go.  Each chunk is at most the burst size of the limiter, so that
+// it can always be satisfied.
+
+type throttle struct {
+	ctx     context.Context
+	limiter Limiter
+	burst   int
+}
+
+func newThrottle(ctx context.Context, l Limiter) throttle {
+	return throttle{ctx: ctx, limiter: l, burst: Burst(l)}
+}
+
+// chunk trims the buffer to the size that may be transferred at once.
+func (t throttle) chunk(p []byte) []byte {
+	if t.burst > 0 && len(p) > t.burst {
+		return p[:t.burst]
+	}
+	return p
+}
+
+// wait blocks until n bytes may be transferred.
+func (t throttle) wait(n int) error {
+	res, err := AcquireTokens(t.ctx, t.limiter, n, 0)
+	if err != nil {
+		if t.ctx.Err() != nil {
+			return t.ctx.Err()
+		}
+		return err
+	}
+	if !res {
+		return ErrThrottled
+	}
+	return nil
+}
+
+type reader struct {
+	throttle
+	r io.Reader
+}
+
+// NewReader returns a reader that reads from r no faster than the
+// limiter allows.  Reads are abandoned if the context is canceled.
+func NewReader(ctx context.Context, r io.Reader, l Limiter) io.Reader {
+	return &reader{throttle: newThrottle(ctx, l), r: r}
+}
+
+func (tr *reader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(tr.chunk(p))
+	if n > 0 {
+		if werr := tr.wait(n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type writer struct {
+	throttle
+	w io.Writer
+}
+
+// NewWriter returns a writer that writes to w no faster than the
+// limiter allows.  Writes are abandoned if the context is canceled.
+func NewWriter(ctx context.Context, w io.Writer, l Limiter) io.Writer {
+	return &writer{throttle: newThrottle(ctx, l), w: w}
+}
+
+func (tw *writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		c := tw.chunk(p)
+		if err := tw.wait(len(c)); err != nil {
+			return written, err
+		}
+		n, err := tw.w.Write(c)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type conn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+// NewConn returns a connection whose reads and writes are paced by the
+// respective limiters.  Either limiter may be nil, in which case that
+// direction isn't throttled.  The context should be canceled once the
+// connection is closed, so that pending waits are released.
+func NewConn(ctx context.Context, c net.Conn, read, write Limiter) net.Conn {
+	tc := &conn{Conn: c, r: c, w: c}
+	if read != nil {
+		tc.r = NewReader(ctx, c, read)
+	}
+	if write != nil {
+		tc.w = NewWriter(ctx, c, write)
+	}
+	return tc
+}
+
+func (tc *conn) Read(p []byte) (int, error) {
+	return tc.r.Read(p)
+}
+
+func (tc *conn) Write(p []byte) (int, error) {
+	return tc.w.Write(p)
+}
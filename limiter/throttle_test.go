@@ -0,0 +1,53 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Test that reads and writes are paced to the byte rate.
+func TestThrottledReaderWriter(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("x"), 300)
+
+	// 100 bytes are on hand, the other 200 take 200ms at 1000 bytes/sec.
+	b, err := NewBucketLimiter(1000, Sec, 100)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v", err)
+	}
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, NewReader(ctx, bytes.NewReader(data), b))
+	if err != nil || n != 300 {
+		t.Fatalf("unexpected read: %d, %v", n, err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("read was not throttled: %v", d)
+	}
+
+	b, err = NewBucketLimiter(1000, Sec, 100)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v", err)
+	}
+	var buf bytes.Buffer
+	start = time.Now()
+	if n, err := NewWriter(ctx, &buf, b).Write(data); err != nil || n != 300 {
+		t.Fatalf("unexpected write: %d, %v", n, err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("write was not throttled: %v", d)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("data was corrupted")
+	}
+
+	// Once canceled, the writer gives up.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := NewWriter(cctx, &buf, b).Write(data); err == nil {
+		t.Fatalf("expected canceled write to fail")
+	}
+}
@@ -5,10 +5,11 @@ package restclient
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strings"
 	"time"
@@ -23,16 +24,41 @@ const (
 type EventService struct {
 	serviceURL string
 	client     *http.Client
+	maxWait    string
+}
+
+// An Option configures optional behavior of an EventService.
+type Option func(*EventService)
+
+// WithTransport sets the transport used to make requests, such as one
+// returned by NewLimitedTransport.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(es *EventService) {
+		es.client.Transport = rt
+	}
+}
+
+// WithMaxWait asks the rate limiter to wait no longer than the given
+// time for a token before turning a request away, with 0 meaning it
+// should fail fast.  The server caps it at a ceiling of its own.
+func WithMaxWait(d time.Duration) Option {
+	return func(es *EventService) {
+		es.maxWait = d.String()
+	}
 }
 
 // NewEventService creates a new REST service using the specified
 // endpoint.  The resource type will be appended to the URL by
-// the invoker for the REST call.
-func NewEventService(serviceURL string) (*EventService, error) {
+// the invoker for the REST call.  Any options are applied in order.
+func NewEventService(serviceURL string, opts ...Option) (*EventService,
+	error) {
 	es := &EventService{}
 	es.client = &http.Client{
 		Timeout: time.Duration(connTimeout) * time.Second,
 	}
+	for _, opt := range opts {
+		opt(es)
+	}
 	if _, err := url.Parse(serviceURL); err != nil {
 		return nil, fmt.Errorf("Invalid service URL: %s", serviceURL)
 	}
@@ -45,22 +71,47 @@ func NewEventService(serviceURL string) (*EventService, error) {
 
 // StoreEvent stores a string containing a JSON-encoded event.
 // Returns an error if there was a server error (other than the
-// server being too busy), and true or false as to whether the
-// store was successful.  This boolean will give the app the
-// option of retrying if timeout occurred.
+// server being too busy, or the client-side limiter holding the
+// request back), and true or false as to whether the store was
+// successful.  This boolean will give the app the option of retrying
+// if timeout occurred.  Each call sends a new idempotency key, so a
+// retry should be made with StoreEventWithKey, to be safe from storing
+// the event twice.
 func (es EventService) StoreEvent(event string) (bool, error) {
+	return es.StoreEventWithKey(NewIdempotencyKey(), event)
+}
+
+// StoreEventWithKey is StoreEvent with an idempotency key made by the
+// caller, such as by NewIdempotencyKey.  Retrying a store with the same
+// key, after a timeout or a busy server, gets back the outcome of the
+// first attempt that reached the event store, if there was one, rather
+// than storing the event again, provided the proxy has idempotency keys
+// enabled.
+func (es EventService) StoreEventWithKey(key, event string) (bool, error) {
 
 	// This call should return HTTP 201 if successful.
-	resp, err := es.client.Post(es.serviceURL+resource, "application/json",
+	req, err := http.NewRequest("POST", es.serviceURL+resource,
 		bytes.NewReader([]byte(event)))
-	if err == nil {
-		b, _ := httputil.DumpResponse(resp, true)
-		log.Println(string(b))
-	}
-
 	if err != nil {
 		return false, err
-	} else if resp.StatusCode == 503 {
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	if es.maxWait != "" {
+		req.Header.Set("X-RateLimit-Max-Wait", es.maxWait)
+	}
+	resp, err := es.client.Do(req)
+	if errors.Is(err, ErrRateLimited) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// Drain the body, so that the connection can be reused.
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusTooManyRequests {
 		return false, nil
 	} else if resp.StatusCode >= 300 {
 		return false, fmt.Errorf("Store failed with status code %d (%s)",
@@ -69,4 +120,15 @@ func (es EventService) StoreEvent(event string) (bool, error) {
 	return true, nil
 }
 
+// NewIdempotencyKey makes up a random idempotency key, in the form of a
+// version 4 UUID.
+func NewIdempotencyKey() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:])
+}
+
 // Add other "REST" services ...
@@ -0,0 +1,53 @@
+package restclient
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// ErrRateLimited is returned when the client-side limiter did not
+// hand out a token for a request in time.
+var ErrRateLimited = errors.New("client rate limit exceeded")
+
+// limitedTransport is an http.RoundTripper that acquires a token from
+// a Limiter before passing each request on to the wrapped transport.
+type limitedTransport struct {
+	base    http.RoundTripper
+	limiter limiter.Limiter
+	timeout time.Duration
+}
+
+// NewLimitedTransport wraps the transport so that requests are paced by
+// the limiter, which lets a producer keep to the server's published
+// rate instead of collecting rejections.  Each request waits up to the
+// timeout for a token, with 0 meaning no timeout, and fails with
+// ErrRateLimited if none arrives.  A nil base means the default
+// transport.  If the limiter has a token server, the caller is
+// responsible for running it.
+func NewLimitedTransport(base http.RoundTripper, l limiter.Limiter,
+	timeout time.Duration) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &limitedTransport{base: base, limiter: l, timeout: timeout}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (lt *limitedTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	res, err := lt.limiter.AcquireToken(req.Context(), lt.timeout)
+	if err == nil && !res {
+		err = ErrRateLimited
+	}
+	if err != nil {
+		// The transport is required to close the body, even on errors.
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return lt.base.RoundTrip(req)
+}
@@ -0,0 +1,72 @@
+package restclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// Test that the limited transport holds back requests over the rate,
+// and that the store reports them as not stored rather than failed.
+func TestLimitedTransport(t *testing.T) {
+	var hits int64
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&hits, 1)
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer ts.Close()
+
+	l, err := limiter.NewBucketLimiter(1, limiter.Min, 1)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v", err)
+	}
+	es, err := NewEventService(ts.URL, WithTransport(
+		NewLimitedTransport(nil, l, 10*time.Millisecond)))
+	if err != nil {
+		t.Fatalf("Creating rest client failed: %v", err)
+	}
+
+	if res, err := es.StoreEvent("{}"); err != nil || !res {
+		t.Fatalf("expected store to succeed, got %t, %v", res, err)
+	}
+	if res, err := es.StoreEvent("{}"); err != nil || res {
+		t.Fatalf("expected store to be limited, got %t, %v", res, err)
+	}
+	if hits != 1 {
+		t.Fatalf("expected 1 request to reach the server, got %d", hits)
+	}
+}
+
+// Test that each store sends an idempotency key, and that a retry with
+// StoreEventWithKey sends the same one.
+func TestIdempotencyKey(t *testing.T) {
+	keys := make(chan string, 3)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			keys <- r.Header.Get("Idempotency-Key")
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer ts.Close()
+
+	es, err := NewEventService(ts.URL)
+	if err != nil {
+		t.Fatalf("Creating rest client failed: %v", err)
+	}
+	es.StoreEvent("{}")
+	es.StoreEvent("{}")
+	if a, b := <-keys, <-keys; len(a) != 36 || a == b {
+		t.Fatalf("expected distinct UUIDs, got %q and %q", a, b)
+	}
+	key := NewIdempotencyKey()
+	if res, err := es.StoreEventWithKey(key, "{}"); err != nil || !res {
+		t.Fatalf("expected store to succeed, got %t, %v", res, err)
+	}
+	if k := <-keys; k != key {
+		t.Fatalf("expected key %q, got %q", key, k)
+	}
+}
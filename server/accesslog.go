@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// requestIDHeader carries the ID of a request.  An ID sent by the client
+// is kept, and one is made up otherwise.  Either way, it is passed on to
+// the backend and returned in the response, so that the request can be
+// traced through the logs of both.
+const requestIDHeader = "X-Request-ID"
+
+// The decisions recorded in the access log.
+const (
+	DecisionAdmitted     = "admitted"     // got its tokens
+	DecisionUnlimited    = "unlimited"    // wasn't limited at all
+	DecisionRejected     = "rejected"     // ran out of time, or found the queue full
+	DecisionCanceled     = "canceled"     // the client gave up waiting
+	DecisionTooLarge     = "too_large"    // costs more than the bucket holds
+	DecisionBreakerOpen  = "breaker_open" // admitted, but failed fast
+	DecisionShed         = "shed"         // admitted, but over the concurrency limit
+	DecisionBackpressure = "backpressure" // admitted, but the service asked for less
+	DecisionBusy         = "busy"         // admitted, but every backend was at its limit
+	DecisionError        = "error"        // the limiter failed
+	DecisionDenied       = "denied"       // came from a denied network
+	DecisionReplayed     = "replayed"     // answered from the idempotency cache
+)
+
+// An AccessEntry is a line of the access log, as written by
+// WithAccessLog.  It says who the client was, by its key under the
+// policy its request matched, what the limiter decided, how long the
+// request waited for its tokens, and how many were left.  For requests
+// that were forwarded, it also gives the backend, its status and how
+// long it took to answer.  Times are in milliseconds.
+type AccessEntry struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Remote         string    `json:"remote"`
+	Key            string    `json:"key,omitempty"`
+	Policy         string    `json:"policy"`
+	Decision       string    `json:"decision"`
+	Cost           int       `json:"cost,omitempty"`
+	Wait           float64   `json:"wait_ms"`
+	Remaining      *int      `json:"remaining,omitempty"`
+	Status         int       `json:"status"`
+	Backend        string    `json:"backend,omitempty"`
+	BackendStatus  int       `json:"backend_status,omitempty"`
+	BackendLatency float64   `json:"backend_latency_ms,omitempty"`
+	BackendError   string    `json:"backend_error,omitempty"`
+	Duration       float64   `json:"duration_ms"`
+
+	// Shadow gives the decisions of the shadow policies, if any.
+	Shadow []ShadowDecision `json:"shadow,omitempty"`
+
+	pending *sync.WaitGroup // shadow decisions yet to be made
+}
+
+// accessKey is the context key of a request's access log entry.
+type accessKey struct{}
+
+// entryOf returns the access log entry of the request, or nil if there
+// is no access log.  The methods on an entry do nothing if it's nil.
+func entryOf(ctx context.Context) *AccessEntry {
+	e, _ := ctx.Value(accessKey{}).(*AccessEntry)
+	return e
+}
+
+// decide records the decision, and the tokens left in the limiter.
+func (e *AccessEntry) decide(decision string, lim limiter.Limiter) {
+	if e == nil {
+		return
+	}
+	e.Decision = decision
+	if st, ok := limiter.StateOf(lim); ok {
+		remaining := int(math.Max(0, math.Floor(st.Tokens)))
+		e.Remaining = &remaining
+	}
+}
+
+// backendDone records the outcome of the request to the backend.
+func (e *AccessEntry) backendDone(b *backend, resp *http.Response, err error,
+	latency time.Duration) {
+	if e == nil {
+		return
+	}
+	e.Backend = b.URL
+	e.BackendLatency = millis(latency)
+	if err != nil {
+		e.BackendError = err.Error()
+	} else {
+		e.BackendStatus = resp.StatusCode
+	}
+}
+
+// logAccess writes an access log entry for each request, once it has
+// been answered.
+func (ls *LimiterServer) logAccess(next http.Handler) http.Handler {
+	if ls.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		e := &AccessEntry{Time: start.UTC(), RequestID: id, Method: r.Method,
+			Path: r.URL.Path, Remote: r.RemoteAddr}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(),
+			accessKey{}, e)))
+		e.Status = sw.status
+		e.Duration = millis(time.Since(start))
+		if e.pending == nil {
+			ls.writeEntry(e)
+			return
+		}
+		go func() {
+			e.pending.Wait()
+			ls.writeEntry(e)
+		}()
+	})
+}
+
+// writeEntry writes a line to the access log.
+func (ls *LimiterServer) writeEntry(e *AccessEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Access log entry failed: %v\n", err)
+		return
+	}
+	ls.accessMu.Lock()
+	defer ls.accessMu.Unlock()
+	if _, err := ls.accessLog.Write(append(b, '\n')); err != nil {
+		log.Printf("Access log write failed: %v\n", err)
+	}
+}
+
+// newRequestID makes up a random request ID.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// statusWriter remembers the status of the response.  A request that
+// nobody answered, such as one whose client gave up, has a status of 0.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush sends any buffered data, if the underlying writer supports it.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// Test that the access log says why each request was or wasn't let
+// through, and how the backend answered.
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(requestIDHeader) == "" {
+				t.Errorf("request ID not passed on")
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer backend.Close()
+
+	reg := limiter.NewRegistry(func(string) (limiter.Limiter, error) {
+		return limiter.NewBucketLimiter(1, limiter.Min, 1)
+	}, time.Minute, 0)
+	var buf bytes.Buffer
+	server := NewLimiterServer(8080, nil, 10*time.Millisecond, backend.URL,
+		WithKeyedLimits(reg, HeaderKey("X-API-Key")), WithAccessLog(&buf))
+
+	var ids []string
+	for _, id := range []string{"", "abc"} {
+		r := httptest.NewRequest("POST", "/events", nil)
+		r.Header.Set("X-API-Key", "alice")
+		if id != "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		ids = append(ids, w.Header().Get(requestIDHeader))
+	}
+
+	dec := json.NewDecoder(&buf)
+	for i, want := range []AccessEntry{
+		{Key: "alice", Policy: defaultPolicy, Decision: DecisionAdmitted,
+			Status: http.StatusCreated, Backend: backend.URL,
+			BackendStatus: http.StatusCreated},
+		{RequestID: "abc", Key: "alice", Policy: defaultPolicy,
+			Decision: DecisionRejected, Status: http.StatusServiceUnavailable},
+	} {
+		var e AccessEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("%d: Decode failed: %v", i, err)
+		}
+		if want.RequestID == "" {
+			want.RequestID = ids[0]
+		}
+		if e.RequestID != want.RequestID || ids[i] != want.RequestID ||
+			e.Key != want.Key || e.Policy != want.Policy ||
+			e.Decision != want.Decision || e.Status != want.Status ||
+			e.Backend != want.Backend || e.BackendStatus != want.BackendStatus {
+			t.Fatalf("%d: expected %+v, got %+v", i, want, e)
+		}
+		if e.Cost != 1 || e.Remaining == nil || *e.Remaining != 0 {
+			t.Fatalf("%d: unexpected cost or remaining tokens: %+v", i, e)
+		}
+	}
+	if dec.More() {
+		t.Fatalf("unexpected extra entries")
+	}
+}
@@ -0,0 +1,488 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// The admin API is served on a listener of its own, apart from the
+// public port, and lets support staff inspect and change limits at
+// runtime:
+//
+//	GET    /admin/limits                        list policies and buckets
+//	GET    /admin/limits/{policy}               show one policy
+//	PUT    /admin/limits/{policy}               change its rate and burst
+//	DELETE /admin/limits/{policy}/keys/{key}    reset a client's bucket
+//	POST   /admin/limits/{policy}/keys/{key}    override a client's limits
+//	GET    /admin/breaker                       show the circuit breaker
+//	GET    /admin/stats                         count admitted requests
+//
+// Changes to a policy from a rule set last until the rules are next
+// reloaded from file, and those to any other policy, such as the
+// default one, until the server is restarted.  Every change is written
+// to the audit log, along with who made it and when.  The admin port
+// only listens on the loopback interface unless told otherwise, and with
+// an authorizer, every request must authenticate, and changes are
+// audited with the user it vouches for.  Without one, the user is taken
+// from basic auth or the X-Admin-User header, and audited as unverified.
+const (
+	adminPrefix  = "/admin/limits"
+	adminBreaker = "/admin/breaker"
+	adminStats   = "/admin/stats"
+)
+
+// Limits on what the admin API lists and allows.
+const (
+	maxListedKeys      = 1000
+	defaultOverrideTTL = time.Hour
+)
+
+// policyStatus describes a policy and the live state of its buckets.
+type policyStatus struct {
+	Name      string                    `json:"name"`
+	Config    *PolicyConfig             `json:"config,omitempty"`
+	State     *limiter.State            `json:"state,omitempty"`
+	Keys      map[string]limiter.State  `json:"keys,omitempty"`
+	Overrides map[string]overrideStatus `json:"overrides,omitempty"`
+}
+
+type overrideStatus struct {
+	State     *limiter.State `json:"state,omitempty"`
+	Unlimited bool           `json:"unlimited,omitempty"`
+	Expires   time.Time      `json:"expires"`
+}
+
+// limitUpdate is the body of a request changing limits.  Fields that
+// are left out keep their current values.
+type limitUpdate struct {
+	Rate     int    `json:"rate,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Burst    int    `json:"burst,omitempty"`
+}
+
+// overrideRequest is the body of a request overriding a client's limits.
+type overrideRequest struct {
+	limitUpdate
+	Unlimited bool     `json:"unlimited,omitempty"`
+	TTL       Duration `json:"ttl,omitempty"`
+}
+
+// auditEntry records a change made through the admin API.
+type auditEntry struct {
+	Time     time.Time   `json:"time"`
+	User     string      `json:"user"`
+	Verified bool        `json:"verified"`
+	Remote   string      `json:"remote"`
+	Action   string      `json:"action"`
+	Policy   string      `json:"policy"`
+	Key      string      `json:"key,omitempty"`
+	Detail   interface{} `json:"detail,omitempty"`
+}
+
+// An AdminAuthorizer authenticates a request to the admin API, and
+// returns the user who made it, or false to turn it away.
+type AdminAuthorizer func(r *http.Request) (string, bool)
+
+// AdminCredentials returns an authorizer that takes basic auth with one
+// of the users, mapped to their passwords.
+func AdminCredentials(users map[string]string) AdminAuthorizer {
+	return func(r *http.Request) (string, bool) {
+		user, password, ok := r.BasicAuth()
+		want, known := users[user]
+		if !ok || !known || subtle.ConstantTimeCompare([]byte(password),
+			[]byte(want)) != 1 {
+			return "", false
+		}
+		return user, true
+	}
+}
+
+// LoadAdminCredentials reads the users and passwords of the admin API
+// from a file, one "user:password" per line, as per AdminCredentials.
+// Blank lines, and lines starting with a "#", are ignored.
+func LoadAdminCredentials(file string) (AdminAuthorizer, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", file, i+1)
+		}
+		users[user] = password
+	}
+	return AdminCredentials(users), nil
+}
+
+// adminUserKey is the context key of the user vouched for by the
+// authorizer.
+type adminUserKey struct{}
+
+// adminHandler returns the handler for the admin API.
+func (ls *LimiterServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix, ls.adminLimits)
+	mux.HandleFunc(adminPrefix+"/", ls.adminLimits)
+	mux.HandleFunc(adminBreaker, ls.adminBreaker)
+	mux.HandleFunc(adminStats, ls.adminStats)
+	if ls.adminAuth == nil {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := ls.adminAuth(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(),
+			adminUserKey{}, user)))
+	})
+}
+
+func (ls *LimiterServer) adminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, ls.Stats())
+}
+
+func (ls *LimiterServer) adminBreaker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ls.breaker == nil {
+		http.Error(w, "No circuit breaker configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, ls.breaker.stats())
+}
+
+func (ls *LimiterServer) adminLimits(w http.ResponseWriter, r *http.Request) {
+	var parts []string
+	for _, p := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(),
+		adminPrefix), "/") {
+		if p == "" {
+			continue
+		}
+		p, err := url.PathUnescape(p)
+		if err != nil {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		parts = append(parts, p)
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		var res []policyStatus
+		for _, p := range ls.policies() {
+			res = append(res, statusOf(p))
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+		writeJSON(w, http.StatusOK, res)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		if p := ls.findPolicy(w, parts[0]); p != nil {
+			writeJSON(w, http.StatusOK, statusOf(p))
+		}
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		ls.updatePolicy(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "keys" && r.Method == http.MethodDelete:
+		ls.resetKey(w, r, parts[0], parts[2])
+	case len(parts) == 3 && parts[1] == "keys" && r.Method == http.MethodPost:
+		ls.overrideKey(w, r, parts[0], parts[2])
+	case len(parts) == 0 || len(parts) == 1 ||
+		(len(parts) == 3 && parts[1] == "keys"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// findPolicy looks up a policy by name, and writes a 404 if there's no
+// such policy.  A rule set policy takes precedence over the default.
+func (ls *LimiterServer) findPolicy(w http.ResponseWriter,
+	name string) *policy {
+	if rs := ls.currentRules(); rs != nil {
+		if p, ok := rs.policies[name]; ok {
+			return p
+		}
+	}
+	if name == defaultPolicy {
+		return ls.policy
+	}
+	if name == allowPolicy && ls.allowPolicy != nil {
+		return ls.allowPolicy
+	}
+	for _, s := range ls.shadowPolicies {
+		if s.policy.name == name {
+			return s.policy
+		}
+	}
+	http.Error(w, "Unknown policy", http.StatusNotFound)
+	return nil
+}
+
+// updatePolicy changes the rate and burst of a policy.  Its limiters are
+// adjusted in place, so that clients keep the tokens they have, up to
+// the new burst size, and so do its overrides.
+func (ls *LimiterServer) updatePolicy(w http.ResponseWriter, r *http.Request,
+	name string) {
+	var upd limitUpdate
+	if !readJSON(w, r, &upd) {
+		return
+	}
+
+	// A reload mustn't replace the policy while it's being changed.
+	ls.reloadMu.Lock()
+	defer ls.reloadMu.Unlock()
+	p := ls.findPolicy(w, name)
+	if p == nil {
+		return
+	}
+	var rate float64
+	if upd.Rate != 0 || upd.Interval != "" {
+		interval, err := parseInterval(upd.Interval)
+		if err == nil && upd.Rate <= 0 {
+			err = fmt.Errorf("a positive rate is needed")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rate = float64(upd.Rate) / intervalSeconds(interval)
+	}
+	if upd.Burst < 0 {
+		http.Error(w, "'burst' must be positive", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case p.keyed != nil:
+		err = p.keyed.Adjust(rate, upd.Burst)
+	case p.limiter != nil:
+		err = limiter.Adjust(p.limiter, rate, upd.Burst)
+	default:
+		err = errors.New("policy is unlimited")
+	}
+	if err != nil {
+		http.Error(w, "Policy can't be changed: "+err.Error(),
+			http.StatusConflict)
+		return
+	}
+	p.update(upd)
+	ls.audit(r, "update", name, "", upd)
+	writeJSON(w, http.StatusOK, statusOf(p))
+}
+
+// intervalSeconds returns the length of the interval in seconds.
+func intervalSeconds(interval limiter.IntervalType) float64 {
+	switch interval {
+	case limiter.Msec:
+		return time.Millisecond.Seconds()
+	case limiter.Min:
+		return time.Minute.Seconds()
+	}
+	return 1
+}
+
+// resetKey discards a client's bucket and any override, so that it
+// starts over with a full bucket.
+func (ls *LimiterServer) resetKey(w http.ResponseWriter, r *http.Request,
+	name, key string) {
+	p := ls.findPolicy(w, name)
+	if p == nil {
+		return
+	}
+	if p.keyed == nil {
+		http.Error(w, "Policy is not keyed", http.StatusConflict)
+		return
+	}
+
+	p.setOverride(key, nil)
+	p.keyed.Delete(key)
+	ls.audit(r, "reset", name, key, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// overrideKey gives a client limits of its own for a while, or lets it
+// through unlimited.  Unspecified limits are those the policy's limiters
+// have now.
+func (ls *LimiterServer) overrideKey(w http.ResponseWriter, r *http.Request,
+	name, key string) {
+	var req overrideRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	p := ls.findPolicy(w, name)
+	if p == nil {
+		return
+	}
+	if p.keyed == nil {
+		http.Error(w, "Policy is not keyed", http.StatusConflict)
+		return
+	}
+
+	ttl := time.Duration(req.TTL)
+	if ttl <= 0 {
+		ttl = defaultOverrideTTL
+	}
+	o := &override{expires: time.Now().Add(ttl)}
+	if !req.Unlimited {
+		rate, burst, ok := p.keyed.Limits()
+		if req.Rate != 0 || req.Interval != "" {
+			interval, err := parseInterval(req.Interval)
+			if err == nil && req.Rate <= 0 {
+				err = fmt.Errorf("a positive rate is needed")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rate = float64(req.Rate) / intervalSeconds(interval)
+		}
+		if req.Burst != 0 {
+			burst = req.Burst
+		}
+		if (!ok && (req.Rate == 0 || req.Burst == 0)) || burst <= 0 {
+			http.Error(w, "Both 'rate' and 'burst' are needed",
+				http.StatusBadRequest)
+			return
+		}
+
+		// No token server is needed, so nothing has to be run.
+		b, err := limiter.NewBucketLimiter(1, limiter.Sec, burst)
+		if err == nil {
+			err = b.Adjust(rate, 0)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o.limiter = b
+	}
+
+	p.setOverride(key, o)
+	ls.audit(r, "override", name, key, req)
+	writeJSON(w, http.StatusOK, overrideStatusOf(o))
+}
+
+// audit records who changed what through the admin API.
+func (ls *LimiterServer) audit(r *http.Request, action, policy, key string,
+	detail interface{}) {
+	user, verified := r.Context().Value(adminUserKey{}).(string)
+	if !verified {
+		var ok bool
+		if user, _, ok = r.BasicAuth(); !ok {
+			user = r.Header.Get("X-Admin-User")
+		}
+	}
+	if user == "" {
+		user = "unknown"
+	}
+	b, err := json.Marshal(auditEntry{Time: time.Now().UTC(), User: user,
+		Verified: verified, Remote: r.RemoteAddr, Action: action,
+		Policy: policy, Key: key, Detail: detail})
+	if err != nil {
+		log.Printf("Audit entry failed: %v\n", err)
+		return
+	}
+
+	ls.auditMu.Lock()
+	defer ls.auditMu.Unlock()
+	if ls.auditLog == nil {
+		log.Printf("Audit: %s\n", b)
+		return
+	}
+	if _, err := fmt.Fprintf(ls.auditLog, "%s\n", b); err != nil {
+		log.Printf("Audit log write failed: %v\n", err)
+	}
+}
+
+// statusOf describes the policy and the state of its buckets.
+func statusOf(p *policy) policyStatus {
+	ps := policyStatus{Name: p.name, Config: p.limits()}
+	if p.limiter != nil && p.keyed == nil {
+		if st, ok := limiter.StateOf(p.limiter); ok {
+			ps.State = &st
+		}
+	}
+	if p.keyed != nil {
+		ps.Keys = make(map[string]limiter.State)
+		p.keyed.Range(func(key string, l limiter.Limiter) bool {
+			if st, ok := limiter.StateOf(l); ok {
+				ps.Keys[key] = st
+			}
+			return len(ps.Keys) < maxListedKeys
+		})
+	}
+
+	p.mu.Lock()
+	keys := make([]string, 0, len(p.overrides))
+	for key := range p.overrides {
+		keys = append(keys, key)
+	}
+	p.mu.Unlock()
+	for _, key := range keys {
+		if o := p.override(key); o != nil {
+			if ps.Overrides == nil {
+				ps.Overrides = make(map[string]overrideStatus)
+			}
+			ps.Overrides[key] = overrideStatusOf(o)
+		}
+	}
+	return ps
+}
+
+func overrideStatusOf(o *override) overrideStatus {
+	status := overrideStatus{Unlimited: o.limiter == nil, Expires: o.expires}
+	if o.limiter != nil {
+		if st, ok := limiter.StateOf(o.limiter); ok {
+			status.State = &st
+		}
+	}
+	return status
+}
+
+// readJSON decodes the request body, and writes a 400 if it's invalid.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		http.Error(w, "Invalid JSON in payload: "+err.Error(),
+			http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Writing response failed: %v\n", err)
+	}
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+const adminRules = `{
+  "policies": {
+    "clients": {"algorithm": "bucket", "rate": 1, "interval": "min",
+                "burst": 1, "key": "header:X-API-Key", "timeout": "10ms"}
+  },
+  "rules": [{"policy": "clients"}]
+}`
+
+func TestAdmin(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(adminRules))
+	if err != nil {
+		t.Fatalf("Parsing rules failed: %v", err)
+	}
+	var audit bytes.Buffer
+	server := NewLimiterServer(8080, nil, time.Second, "http://dummy",
+		WithRules(rs), WithAuditLog(&audit))
+	var x int64
+	ph := placeHolder{&x}
+	h := server.enforceLimits(http.HandlerFunc(ph.eventHandler))
+	admitted := func(key string) bool {
+		before := x
+		r := httptest.NewRequest("GET", "/events", nil)
+		r.Header.Set("X-API-Key", key)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		return x > before
+	}
+	admin := server.adminHandler()
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-Admin-User", "support")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	if !admitted("abuser") || admitted("abuser") {
+		t.Fatalf("expected one request to be admitted")
+	}
+	if !admitted("drained") {
+		t.Fatalf("expected one request to be admitted")
+	}
+
+	// The client's bucket shows up in the listing.
+	w := call("GET", "/admin/limits", "")
+	var list []policyStatus
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("Decoding list failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "clients" ||
+		list[0].Keys["abuser"].Tokens >= 1 {
+		t.Fatalf("unexpected listing: %+v", list)
+	}
+
+	// Resetting the key gives it a full bucket.
+	if w := call("DELETE", "/admin/limits/clients/keys/abuser", ""); w.Code !=
+		http.StatusNoContent {
+		t.Fatalf("reset failed with status %d", w.Code)
+	}
+	if !admitted("abuser") {
+		t.Fatalf("expected reset key to be admitted")
+	}
+
+	// An unlimited override lets everything through until it expires.
+	if w := call("POST", "/admin/limits/clients/keys/abuser",
+		`{"unlimited": true, "ttl": "1m"}`); w.Code != http.StatusOK {
+		t.Fatalf("override failed with status %d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if !admitted("abuser") {
+			t.Fatalf("expected overridden key to be admitted")
+		}
+	}
+
+	// Raising the burst applies to new buckets, and to the existing ones
+	// without refilling them.
+	if w := call("PUT", "/admin/limits/clients", `{"burst": 2}`); w.Code !=
+		http.StatusOK {
+		t.Fatalf("update failed with status %d", w.Code)
+	}
+	if !admitted("other") || !admitted("other") || admitted("other") {
+		t.Fatalf("expected a burst of 2 after the update")
+	}
+	if admitted("drained") {
+		t.Fatalf("expected the drained bucket to stay empty")
+	}
+	if p := server.currentRules().policies["clients"]; p.limits().Burst != 2 {
+		t.Fatalf("expected the new burst to be recorded")
+	}
+
+	// Reloading rules that leave the policy as it was keeps the change.
+	again, err := ParseRules(strings.NewReader(adminRules))
+	if err != nil {
+		t.Fatalf("Parsing rules failed: %v", err)
+	}
+	if err := server.swapRules(again.config); err != nil {
+		t.Fatalf("Reloading rules failed: %v", err)
+	}
+	if p := server.currentRules().policies["clients"]; p.limits().Burst != 2 {
+		t.Fatalf("expected the change to survive the reload")
+	}
+	// The override outlives the update.
+	for i := 0; i < 3; i++ {
+		if !admitted("abuser") {
+			t.Fatalf("expected the override to be kept")
+		}
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/admin/limits/default", `{"burst": 2}`, http.StatusConflict},
+		{"PUT", "/admin/limits/clients", `{"burst": -1}`, http.StatusBadRequest},
+		{"PUT", "/admin/limits/clients", `{"brust": 2}`, http.StatusBadRequest},
+		{"GET", "/admin/limits/nope", "", http.StatusNotFound},
+		{"PATCH", "/admin/limits/clients", "", http.StatusMethodNotAllowed},
+	} {
+		if w := call(tc.method, tc.path, tc.body); w.Code != tc.status {
+			t.Fatalf("%s %s: expected status %d, got %d", tc.method, tc.path,
+				tc.status, w.Code)
+		}
+	}
+
+	if n := strings.Count(audit.String(), `"user":"support"`); n != 3 {
+		t.Fatalf("expected 3 audit entries, got %d:\n%s", n, audit.String())
+	}
+}
+
+// Test that the default policy, which doesn't come from a rule set, is
+// changed in place.
+func TestAdminDefaultPolicy(t *testing.T) {
+	b, err := limiter.NewBucketLimiter(1, limiter.Min, 1)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, time.Millisecond, "http://dummy")
+	var x int64
+	ph := placeHolder{&x}
+	h := server.enforceLimits(http.HandlerFunc(ph.eventHandler))
+	admitted := func() bool {
+		before := x
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET",
+			"/events", nil))
+		return x > before
+	}
+	admin := server.adminHandler()
+	call := func(body string) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/limits/default",
+			strings.NewReader(body)))
+		return w.Code
+	}
+
+	if !admitted() || admitted() {
+		t.Fatalf("expected one request to be admitted")
+	}
+	if code := call(`{"rate": 100, "interval": "msec", "burst": 2}`); code !=
+		http.StatusOK {
+		t.Fatalf("update failed with status %d", code)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if st, _ := limiter.StateOf(b); st.Burst != 2 || st.Rate != 100000 ||
+		!admitted() || !admitted() {
+		t.Fatalf("expected the new limits to apply, got %+v", st)
+	}
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"interval": "sec"}`, http.StatusBadRequest},
+		{`{"rate": 1, "interval": "hour"}`, http.StatusBadRequest},
+		{`{"burst": -1}`, http.StatusBadRequest},
+	} {
+		if code := call(tc.body); code != tc.status {
+			t.Fatalf("%s: expected status %d, got %d", tc.body, tc.status,
+				code)
+		}
+	}
+
+	// A pulse limiter's burst is fixed, but its rate isn't.
+	p, _ := limiter.NewPulseLimiter(1, limiter.Min, 1)
+	reg := limiter.NewRegistry(func(string) (limiter.Limiter, error) {
+		return limiter.NewPulseLimiter(1, limiter.Min, 1)
+	}, 0, 0)
+	for _, server = range []*LimiterServer{
+		NewLimiterServer(8080, p, time.Second, "http://dummy"),
+		NewLimiterServer(8080, nil, time.Second, "http://dummy",
+			WithKeyedLimits(reg, RemoteIPKey())),
+	} {
+		admin = server.adminHandler()
+		if code := call(`{"burst": 2}`); code != http.StatusConflict {
+			t.Fatalf("expected a conflict, got %d", code)
+		}
+		if code := call(`{"rate": 2, "interval": "sec"}`); code !=
+			http.StatusOK {
+			t.Fatalf("update failed with status %d", code)
+		}
+	}
+	if st, _ := limiter.StateOf(p); st.Rate != 2 {
+		t.Fatalf("expected a rate of 2, got %+v", st)
+	}
+	l, _ := reg.Get("client")
+	if st, _ := limiter.StateOf(l); st.Rate != 2 {
+		t.Fatalf("expected new keys to get a rate of 2, got %+v", st)
+	}
+
+	// An override takes the limits it doesn't give from the policy.
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST",
+		"/admin/limits/default/keys/client", strings.NewReader(`{"rate": 5}`)))
+	var o overrideStatus
+	if err := json.NewDecoder(w.Body).Decode(&o); err != nil ||
+		w.Code != http.StatusOK {
+		t.Fatalf("override failed with status %d: %v", w.Code, err)
+	}
+	if o.State == nil || o.State.Rate != 5 || o.State.Burst != 1 {
+		t.Fatalf("unexpected override %+v", o.State)
+	}
+}
+
+// Test that the authorizer turns away unknown users, and that changes are
+// audited with the user it vouches for, not the one a caller claims.
+func TestAdminAuth(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(adminRules))
+	if err != nil {
+		t.Fatalf("Parsing rules failed: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "admins")
+	os.WriteFile(file, []byte("# staff\nalice:secret\n\nbob:hunter2\n"), 0600)
+	auth, err := LoadAdminCredentials(file)
+	if err != nil {
+		t.Fatalf("Loading credentials failed: %v", err)
+	}
+	var audit bytes.Buffer
+	server := NewLimiterServer(8080, nil, time.Second, "http://dummy",
+		WithRules(rs), WithAuditLog(&audit), WithAdminAuth(auth))
+	admin := server.adminHandler()
+	call := func(user, password string) int {
+		r := httptest.NewRequest("POST", "/admin/limits/clients/keys/k",
+			strings.NewReader(`{"unlimited": true}`))
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		r.Header.Set("X-Admin-User", "mallory")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, tc := range []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"mallory", "secret", http.StatusUnauthorized},
+		{"alice", "secret", http.StatusOK},
+	} {
+		if code := call(tc.user, tc.password); code != tc.status {
+			t.Fatalf("%s: expected status %d, got %d", tc.user, tc.status,
+				code)
+		}
+	}
+	if s := audit.String(); strings.Count(s, "\n") != 1 ||
+		!strings.Contains(s, `"user":"alice","verified":true`) {
+		t.Fatalf("unexpected audit log:\n%s", s)
+	}
+
+	os.WriteFile(file, []byte("alice\n"), 0600)
+	if _, err := LoadAdminCredentials(file); err == nil {
+		t.Fatalf("expected a line without a password to be rejected")
+	}
+}
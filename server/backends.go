@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// Balance determines how requests are spread over the backends.
+type Balance int
+
+// Balance constants.  RoundRobin takes the backends in turn.
+// LeastOutstanding picks the backend with the fewest requests in flight,
+// taking turns between those that are tied.  WeightedRoundRobin takes
+// the backends in turn, but in proportion to their weights, interleaving
+// them as evenly as possible.
+const (
+	RoundRobin Balance = iota
+	LeastOutstanding
+	WeightedRoundRobin
+)
+
+// Backend describes one replica of the proxied service.
+//
+// The weight is only used by WeightedRoundRobin, with 0 meaning 1.  The
+// limiter, if any, charges one token per request forwarded to the
+// backend, and the concurrency cap, if any, limits how many requests it
+// has in flight.  A backend that is at its limit is passed over, rather
+// than waited for, and a request is turned away only if every backend
+// is at its limit.
+type Backend struct {
+	URL           string
+	Weight        int
+	Limiter       limiter.Limiter
+	MaxConcurrent int
+}
+
+// Defaults for passive health checking.
+const (
+	defaultMaxFails = 5
+	defaultEjectFor = 30 * time.Second
+)
+
+// backendKey is the context key of the backend chosen for a request.
+type backendKey struct{}
+
+type backend struct {
+	Backend
+	target   *url.URL
+	inflight atomic.Int64
+	current  int // for WeightedRoundRobin, guarded by the pool's lock
+
+	mu           sync.Mutex
+	probed       bool
+	probeErr     error
+	fails        int
+	ejectedUntil time.Time
+}
+
+// A pool holds the backends of the proxied service.  A backend is taken
+// out of rotation when it fails the active health probe, if one is
+// configured, or when too many requests in a row to it have failed, in
+// which case it is ejected for a while.  Should no backend be healthy,
+// requests are spread over all of them anyway, rather than failing them
+// all on what may be a stale view of their health.
+type pool struct {
+	balance  Balance
+	backends []*backend
+	maxFails int
+	ejectFor time.Duration
+
+	mu   sync.Mutex
+	next int
+}
+
+func newPool(balance Balance, backends ...Backend) *pool {
+	p := &pool{balance: balance, maxFails: defaultMaxFails,
+		ejectFor: defaultEjectFor}
+	for _, be := range backends {
+		b := &backend{Backend: be}
+		if b.Weight <= 0 {
+			b.Weight = 1
+		}
+		target, err := url.Parse(be.URL)
+		if err != nil {
+			log.Printf("Invalid backend URL %s: %v\n", be.URL, err)
+		} else {
+			b.target = target
+		}
+		p.backends = append(p.backends, b)
+	}
+	return p
+}
+
+// healthy reports whether the backend is in rotation.  The probe result
+// only counts if the backends are being probed.
+func (b *backend) healthy(probing bool, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probing && (!b.probed || b.probeErr != nil) {
+		return false
+	}
+	return !now.Before(b.ejectedUntil)
+}
+
+func (b *backend) setProbe(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probed = true
+	b.probeErr = err
+}
+
+func (b *backend) probeState() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.probed, b.probeErr
+}
+
+// admit takes a slot for a request, if the backend isn't at its limit.
+// It must be called with the pool's lock held.
+func (b *backend) admit() bool {
+	if b.MaxConcurrent > 0 && b.inflight.Load() >= int64(b.MaxConcurrent) {
+		return false
+	}
+	if b.Limiter != nil {
+		if ok, err := b.Limiter.TryAcquireToken(context.Background()); !ok ||
+			err != nil {
+			return false
+		}
+	}
+	b.inflight.Add(1)
+	return true
+}
+
+// done frees the slot taken by admit.
+func (b *backend) done() {
+	b.inflight.Add(-1)
+}
+
+// pick chooses the backend for a request, and takes a slot on it, which
+// must be freed by calling done.  It fails with errTooBusy if every
+// candidate is at its limit.
+func (p *pool) pick(probing bool) (*backend, error) {
+	now := time.Now()
+	var cands []*backend
+	for _, b := range p.backends {
+		if b.healthy(probing, now) {
+			cands = append(cands, b)
+		}
+	}
+	if len(cands) == 0 {
+		cands = append(cands, p.backends...)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(cands) > 0 {
+		i := p.choose(cands)
+		if b := cands[i]; b.admit() {
+			return b, nil
+		}
+		cands = append(cands[:i:i], cands[i+1:]...)
+	}
+	return nil, errTooBusy
+}
+
+// retryAfter estimates the number of seconds until a backend has room
+// again, as the soonest any of their limiters will have a token.  It is
+// 0 if that can't be told, as for a backend at its concurrency cap.
+func (p *pool) retryAfter() int {
+	soonest := -1
+	for _, b := range p.backends {
+		st, ok := limiter.StateOf(b.Limiter)
+		if b.Limiter == nil || !ok {
+			return 0
+		}
+		if s := secondsUntil(st, 1); soonest < 0 || s < soonest {
+			soonest = s
+		}
+	}
+	if soonest < 0 {
+		return 0
+	}
+	return soonest
+}
+
+// choose returns the index of the candidate to try next.  It must be
+// called with the lock held.
+func (p *pool) choose(cands []*backend) int {
+	start := p.next % len(cands)
+	p.next++
+	switch p.balance {
+	case LeastOutstanding:
+		best := start
+		for j := 1; j < len(cands); j++ {
+			i := (start + j) % len(cands)
+			if cands[i].inflight.Load() < cands[best].inflight.Load() {
+				best = i
+			}
+		}
+		return best
+	case WeightedRoundRobin:
+		// Smooth weighted round robin, as done by nginx.
+		best, total := 0, 0
+		for i, b := range cands {
+			b.current += b.Weight
+			total += b.Weight
+			if b.current > cands[best].current {
+				best = i
+			}
+		}
+		cands[best].current -= total
+		return best
+	}
+	return start
+}
+
+// observe counts the outcome of a request to the backend, and ejects it
+// once too many requests in a row have failed.
+func (p *pool) observe(b *backend, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.fails = 0
+		return
+	}
+	if b.fails++; b.fails >= p.maxFails {
+		b.fails = 0
+		b.ejectedUntil = time.Now().Add(p.ejectFor)
+		log.Printf("Backend %s ejected for %v\n", b.URL, p.ejectFor)
+	}
+}
+
+// backendFailed tells whether a round trip failed through a fault of
+// the backend.  It returns false for known if the request failed on
+// the client's side, such as when it was canceled or its body was
+// turned away by the limiter, which says nothing about the backend.
+func backendFailed(resp *http.Response, err error) (failed, known bool) {
+	if errors.Is(err, errBodyTooLarge) || errors.Is(err, errTooBusy) ||
+		errors.Is(err, context.Canceled) {
+		return false, false
+	}
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError,
+		true
+}
+
+// poolTransport reports the outcome of each request to the pool, and to
+// the access log, for the backend in its context, if there is one, its
+// round trip time to the adaptive concurrency limit, and, unless it is a
+// probe, any complaint of overload to the backpressure.  It also marks
+// the request as answered by a backend, for the idempotency cache.
+type poolTransport struct {
+	base http.RoundTripper
+	pool *pool
+	bp   *backpressure
+}
+
+func (pt poolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := pt.base.RoundTrip(r)
+	rtt := time.Since(start)
+	failed, known := backendFailed(resp, err)
+	if b, ok := r.Context().Value(backendKey{}).(*backend); ok {
+		entryOf(r.Context()).backendDone(b, resp, err, rtt)
+		if known {
+			pt.pool.observe(b, failed)
+		}
+		// Only forwarded requests count, not probes, or a single failing
+		// replica would throttle the healthy ones for as long as it's
+		// probed.
+		if pt.bp != nil && err == nil {
+			pt.bp.observe(resp)
+		}
+	}
+	if f, ok := r.Context().Value(forwardedKey{}).(*atomic.Bool); ok &&
+		err == nil {
+		f.Store(true)
+	}
+	if rs, ok := r.Context().Value(rttKey{}).(*rttSample); ok && known {
+		rs.rtt, rs.dropped = rtt, failed
+	}
+	return resp, err
+}
+
+// rttKey is the context key of the round trip time sample taken for the
+// adaptive concurrency limit.
+type rttKey struct{}
+
+// An rttSample is the round trip time of a request to a backend, and
+// whether it failed.  It is left empty if the request never got an
+// answer that says anything about the backend.
+type rttSample struct {
+	rtt     time.Duration
+	dropped bool
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// newBackends starts n backends that report their index in the body,
+// and fail with a 500 while their flag is set.
+func newBackends(t *testing.T, n int) ([]Backend, []*atomic.Bool) {
+	var backends []Backend
+	var failing []*atomic.Bool
+	for i := 0; i < n; i++ {
+		id := string(rune('a' + i))
+		f := &atomic.Bool{}
+		ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if f.Load() {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				w.Write([]byte(id))
+			}))
+		t.Cleanup(ts.Close)
+		backends = append(backends, Backend{URL: ts.URL})
+		failing = append(failing, f)
+	}
+	return backends, failing
+}
+
+func TestBalancing(t *testing.T) {
+	backends, _ := newBackends(t, 3)
+	backends[0].Weight = 3
+
+	for _, tc := range []struct {
+		balance Balance
+		want    string
+	}{
+		{balance: RoundRobin, want: "abcabc"},
+		{balance: WeightedRoundRobin, want: "abacaabaca"},
+		{balance: LeastOutstanding, want: "abcabc"},
+	} {
+		ls := NewLimiterServer(8080, nil, time.Second, "",
+			WithBackends(tc.balance, backends...))
+		var got string
+		for i := 0; i < len(tc.want); i++ {
+			w := httptest.NewRecorder()
+			ls.proxyHandler(w, httptest.NewRequest("GET", "/events", nil))
+			got += w.Body.String()
+		}
+		if got != tc.want {
+			t.Fatalf("balance %d: expected %s, got %s", tc.balance, tc.want,
+				got)
+		}
+	}
+}
+
+func TestBackendEjection(t *testing.T) {
+	backends, failing := newBackends(t, 2)
+	failing[1].Store(true)
+	// The options apply in either order.
+	ls := NewLimiterServer(8080, nil, time.Second, "",
+		WithPassiveHealth(2, time.Minute),
+		WithBackends(RoundRobin, backends...))
+
+	// The failing backend is ejected after its second failure.
+	var got string
+	for i := 0; i < 8; i++ {
+		w := httptest.NewRecorder()
+		ls.proxyHandler(w, httptest.NewRequest("GET", "/events", nil))
+		got += w.Body.String()
+	}
+	if got != "ababaaaa" {
+		t.Fatalf("unexpected backends: %s", got)
+	}
+
+	// Should all backends be down, requests go to them anyway.
+	failing[0].Store(true)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		ls.proxyHandler(w, httptest.NewRequest("GET", "/events", nil))
+	}
+	w := httptest.NewRecorder()
+	ls.proxyHandler(w, httptest.NewRequest("GET", "/events", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the request to be forwarded, got %d", w.Code)
+	}
+
+	// The active probe takes a backend out of rotation too.
+	ls = NewLimiterServer(8080, nil, time.Second, "",
+		WithBackends(RoundRobin, backends...), WithBackendProbe("/", 0))
+	failing[0].Store(false)
+	for _, b := range ls.pool.backends {
+		b.setProbe(ls.probe(context.Background(), b))
+	}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		ls.proxyHandler(w, httptest.NewRequest("GET", "/events", nil))
+		if w.Body.String() != "a" {
+			t.Fatalf("%d: unexpected backend %s", i, w.Body.String())
+		}
+	}
+}
+
+func TestBackendLimits(t *testing.T) {
+	backends, _ := newBackends(t, 2)
+	backends[0].MaxConcurrent = 1
+	backends[1].MaxConcurrent = 1
+	lim, err := limiter.NewBucketLimiter(10, limiter.Min, 10)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	ls := NewLimiterServer(8080, lim, time.Second, "",
+		WithBackends(RoundRobin, backends...))
+
+	// With both backends busy, the next request is turned away.
+	b1, err := ls.pool.pick(false)
+	if err != nil {
+		t.Fatalf("pick failed: %v", err)
+	}
+	b2, err := ls.pool.pick(false)
+	if err != nil || b2 == b1 {
+		t.Fatalf("expected the other backend, got %v", err)
+	}
+	if _, err := ls.pool.pick(false); err != errTooBusy {
+		t.Fatalf("expected errTooBusy, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	ls.proxyHandler(w, httptest.NewRequest("GET", "/events", nil))
+	if w.Code != http.StatusServiceUnavailable ||
+		w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d", w.Code)
+	}
+
+	// A request turned away for want of a backend is refunded, and
+	// counted as rejected rather than admitted.
+	w = httptest.NewRecorder()
+	ls.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+	if w.Code != http.StatusServiceUnavailable ||
+		w.Header().Get("Retry-After") == "" ||
+		w.Header().Get("RateLimit-Remaining") != "10" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	if st := ls.Stats(); st.Admitted != 0 || st.Rejected != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	b1.done()
+	if b, err := ls.pool.pick(false); err != nil || b != b1 {
+		t.Fatalf("expected the freed backend, got %v", err)
+	}
+}
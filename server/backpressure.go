@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Backpressure keeps the server from piling more load onto a proxied
+// service that says it is overloaded, by answering with a 429 or 503.
+// Each such answer cuts the share of admitted requests that are
+// forwarded by the decrease factor, down to the minimum share, and if it
+// carries a Retry-After header, nothing is forwarded until then.  The
+// share then recovers linearly, over the recovery period, as long as
+// the service doesn't complain again.  Requests that aren't forwarded
+// are turned away with a 503, and have their tokens refunded.
+
+// BackpressureConfig sets how far the forwarded share is cut back, and
+// how quickly it recovers.  Zero values are replaced by the defaults.
+type BackpressureConfig struct {
+	// Decrease is the factor the share is cut by on each complaint.
+	Decrease float64
+	// MinShare is the share that is always forwarded, outside of pauses.
+	MinShare float64
+	// Recover is how long the share takes to get back to all requests.
+	Recover time.Duration
+	// MaxPause caps the pause asked for by a Retry-After header.
+	MaxPause time.Duration
+}
+
+// Defaults for backpressure.
+var defaultBackpressureConfig = BackpressureConfig{
+	Decrease: 0.5,
+	MinShare: 0.1,
+	Recover:  30 * time.Second,
+	MaxPause: time.Minute,
+}
+
+// BackpressureStats is a snapshot of the backpressure, as shown by Stats.
+type BackpressureStats struct {
+	Share       float64   `json:"share"`
+	PausedUntil time.Time `json:"paused_until,omitempty"`
+	Overloads   uint64    `json:"overloads"` // complaints from the service
+	Shed        uint64    `json:"shed"`      // requests not forwarded
+}
+
+type backpressure struct {
+	cfg BackpressureConfig
+
+	mu          sync.Mutex
+	share       float64   // as of since
+	since       time.Time // of the last complaint
+	pausedUntil time.Time
+	credit      float64
+	overloads   uint64
+	shed        uint64
+}
+
+func newBackpressure(cfg BackpressureConfig) *backpressure {
+	d := defaultBackpressureConfig
+	if cfg.Decrease <= 0 || cfg.Decrease >= 1 {
+		cfg.Decrease = d.Decrease
+	}
+	if cfg.MinShare <= 0 || cfg.MinShare > 1 {
+		cfg.MinShare = d.MinShare
+	}
+	if cfg.Recover <= 0 {
+		cfg.Recover = d.Recover
+	}
+	if cfg.MaxPause <= 0 {
+		cfg.MaxPause = d.MaxPause
+	}
+	return &backpressure{cfg: cfg, share: 1}
+}
+
+// current returns the share forwarded at the given time.  It must be
+// called with the lock held.
+func (bp *backpressure) current(now time.Time) float64 {
+	if bp.share >= 1 {
+		return 1
+	}
+	recovered := float64(now.Sub(bp.since)) / float64(bp.cfg.Recover)
+	if recovered >= 1 {
+		return 1
+	}
+	return bp.share + (1-bp.share)*recovered
+}
+
+// admit reports whether a request may be forwarded at the given time.
+// If not, it returns how long until it would be worth trying again.
+// Outside of a pause, the share is kept by forwarding a request each
+// time the shares of those turned away add up to a whole one.
+func (bp *backpressure) admit(now time.Time) (bool, time.Duration) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if now.Before(bp.pausedUntil) {
+		bp.shed++
+		return false, bp.pausedUntil.Sub(now)
+	}
+	share := bp.current(now)
+	if share >= 1 {
+		bp.credit = 0
+		return true, 0
+	}
+	if bp.credit += share; bp.credit >= 1 {
+		bp.credit--
+		return true, 0
+	}
+	bp.shed++
+	return false, time.Second
+}
+
+// overloaded cuts the share back, and pauses for as long as asked, up to
+// the maximum pause.
+func (bp *backpressure) overloaded(now time.Time, pause time.Duration) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.overloads++
+	share := bp.current(now) * bp.cfg.Decrease
+	if share < bp.cfg.MinShare {
+		share = bp.cfg.MinShare
+	}
+	bp.share, bp.since = share, now
+	if pause > bp.cfg.MaxPause {
+		pause = bp.cfg.MaxPause
+	}
+	if until := now.Add(pause); until.After(bp.pausedUntil) {
+		bp.pausedUntil = until
+	}
+}
+
+// stats returns a snapshot of the backpressure.
+func (bp *backpressure) stats(now time.Time) BackpressureStats {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	st := BackpressureStats{Share: bp.current(now), Overloads: bp.overloads,
+		Shed: bp.shed}
+	if now.Before(bp.pausedUntil) {
+		st.PausedUntil = bp.pausedUntil
+	}
+	return st
+}
+
+// observe feeds the backend's answer back, if it says it is overloaded.
+func (bp *backpressure) observe(resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests &&
+		resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	now := time.Now()
+	bp.overloaded(now, retryAfter(resp.Header.Get("Retry-After"), now))
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.  It returns 0 if there is none, or it can't
+// be parsed.
+func retryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
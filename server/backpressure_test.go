@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+func TestBackpressureShare(t *testing.T) {
+	bp := newBackpressure(BackpressureConfig{Decrease: 0.5, MinShare: 0.2,
+		Recover: 10 * time.Second, MaxPause: 5 * time.Second})
+	now := time.Now()
+	if ok, _ := bp.admit(now); !ok {
+		t.Fatalf("expected everything to be forwarded before any complaint")
+	}
+
+	// A complaint without Retry-After halves the share, and so every
+	// other request is forwarded.
+	bp.overloaded(now, 0)
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := bp.admit(now); ok {
+			admitted++
+		}
+	}
+	if admitted != 5 {
+		t.Fatalf("expected 5 of 10 to be forwarded, got %d", admitted)
+	}
+
+	// More complaints don't go below the minimum share.
+	for i := 0; i < 5; i++ {
+		bp.overloaded(now, 0)
+	}
+	if st := bp.stats(now); st.Share != 0.2 || st.Overloads != 6 ||
+		st.Shed != 5 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	// The share recovers linearly.
+	if st := bp.stats(now.Add(5 * time.Second)); math.Abs(st.Share-0.6) > 1e-9 {
+		t.Fatalf("expected a share of 0.6 half way, got %v", st.Share)
+	}
+	if ok, _ := bp.admit(now.Add(10 * time.Second)); !ok {
+		t.Fatalf("expected everything to be forwarded once recovered")
+	}
+
+	// Retry-After pauses forwarding, up to the maximum pause.
+	now = now.Add(time.Minute)
+	bp.overloaded(now, time.Hour)
+	ok, wait := bp.admit(now.Add(time.Second))
+	if ok || wait != 4*time.Second {
+		t.Fatalf("expected a pause of another 4s, got %v %v", ok, wait)
+	}
+	if st := bp.stats(now); !st.PausedUntil.Equal(now.Add(5 * time.Second)) {
+		t.Fatalf("unexpected pause %v", st.PausedUntil)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-3", 0},
+		{"soon", 0},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 01 May 2024 11:00:00 GMT", 0},
+	} {
+		if got := retryAfter(tc.value, now); got != tc.want {
+			t.Fatalf("%q: expected %v, got %v", tc.value, tc.want, got)
+		}
+	}
+}
+
+// Test that a backend answering 429 with Retry-After pauses forwarding,
+// and that the requests turned away meanwhile are refunded.
+func TestBackpressure(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if hits.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+		}))
+	defer backend.Close()
+
+	b, err := limiter.NewBucketLimiter(100, limiter.Min, 100)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, time.Second, backend.URL,
+		WithRoutes("/"), WithBackpressure(BackpressureConfig{}))
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+
+	if w := send(); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the backend's 429, got %d", w.Code)
+	}
+	w := send()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the request to be turned away, got %d", w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "1" {
+		t.Fatalf("expected Retry-After of 1, got %q", ra)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected the backend to be left alone, got %d hits", n)
+	}
+	if st, ok := limiter.StateOf(b); !ok || st.Tokens < 98.5 {
+		t.Fatalf("expected the request to be refunded, got %+v", st)
+	}
+	st := server.Stats().Backpressure
+	if st == nil || st.Overloads != 1 || st.Shed != 1 || st.Share < 0.5 ||
+		st.Share > 0.51 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+// Test that a replica failing its probes doesn't count as overload, as
+// only forwarded requests are fed back.
+func TestBackpressureIgnoresProbes(t *testing.T) {
+	sick := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	defer sick.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	ls := NewLimiterServer(8080, nil, time.Second, sick.URL,
+		WithBackends(RoundRobin, Backend{URL: sick.URL},
+			Backend{URL: healthy.URL}),
+		WithBackendProbe("/ping", time.Second),
+		WithBackpressure(BackpressureConfig{}))
+	ctx := context.Background()
+	for _, b := range ls.pool.backends {
+		b.setProbe(ls.probe(ctx, b))
+	}
+	if st := ls.Stats().Backpressure; st.Overloads != 0 || st.Share != 1 {
+		t.Fatalf("expected probes to be ignored, got %+v", st)
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The circuit breaker stops forwarding requests to a failing proxied
+// service, so that clients fail fast rather than each waiting out the
+// connection timeout.  While closed, it counts the outcomes of the
+// requests in each window, and opens if too many of them failed or were
+// slow.  While open, requests are turned away with a 503, and the tokens
+// they were charged are refunded.  Once the open period is over, the
+// breaker is half-open, and lets a few trial requests through: if they
+// all succeed it closes again, but if any of them fails it reopens.
+//
+// A request fails if the service can't be reached or answers with a
+// status of 500 or above, and is slow if the response headers take
+// longer than the slow threshold to arrive.
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+// The states of a circuit breaker.
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (s BreakerState) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// BreakerConfig sets when a circuit breaker opens, and for how long.
+// Zero values are replaced by the defaults.
+type BreakerConfig struct {
+	// Window is the period over which outcomes are counted.
+	Window time.Duration
+	// MinRequests is how many requests a window must have before the
+	// breaker may open, so that a single failure doesn't open it.
+	MinRequests int
+	// ErrorRate is the fraction of failed requests that opens the breaker.
+	ErrorRate float64
+	// SlowThreshold is the latency beyond which a request is slow.
+	SlowThreshold time.Duration
+	// SlowRate is the fraction of slow requests that opens the breaker.
+	SlowRate float64
+	// OpenFor is how long the breaker stays open before trying again.
+	OpenFor time.Duration
+	// Trials is how many requests are let through while half-open.
+	Trials int
+}
+
+// Defaults for the circuit breaker.
+var defaultBreakerConfig = BreakerConfig{
+	Window:        10 * time.Second,
+	MinRequests:   20,
+	ErrorRate:     0.5,
+	SlowThreshold: 5 * time.Second,
+	SlowRate:      0.5,
+	OpenFor:       30 * time.Second,
+	Trials:        5,
+}
+
+// BreakerStats is a snapshot of a circuit breaker, as shown by the admin
+// API.
+type BreakerStats struct {
+	State    BreakerState `json:"state"`
+	Since    time.Time    `json:"since"`
+	Requests int          `json:"requests"` // in the current window
+	Failures int          `json:"failures"`
+	Slow     int          `json:"slow"`
+	Trips    int64        `json:"trips"`    // times it has opened
+	Rejected int64        `json:"rejected"` // requests failed fast
+}
+
+// errBreakerOpen is returned for requests turned away by the breaker.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+type breaker struct {
+	cfg BreakerConfig
+
+	mu          sync.Mutex
+	state       BreakerState
+	since       time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	slow        int
+	gen         int // bumped on every change of state
+	trials      int // trial requests admitted while half-open
+	passed      int // trial requests that succeeded
+	trips       int64
+	rejected    int64
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	d := defaultBreakerConfig
+	if cfg.Window <= 0 {
+		cfg.Window = d.Window
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = d.MinRequests
+	}
+	if cfg.ErrorRate <= 0 {
+		cfg.ErrorRate = d.ErrorRate
+	}
+	if cfg.SlowThreshold <= 0 {
+		cfg.SlowThreshold = d.SlowThreshold
+	}
+	if cfg.SlowRate <= 0 {
+		cfg.SlowRate = d.SlowRate
+	}
+	if cfg.OpenFor <= 0 {
+		cfg.OpenFor = d.OpenFor
+	}
+	if cfg.Trials <= 0 {
+		cfg.Trials = d.Trials
+	}
+	now := time.Now()
+	return &breaker{cfg: cfg, since: now, windowStart: now}
+}
+
+// A ticket is handed to each request the breaker lets through, and is
+// used to report the outcome.  A request that never reached the service
+// is released without an outcome.
+type ticket struct {
+	b     *breaker
+	gen   int
+	trial bool
+	once  sync.Once
+}
+
+type ticketKey struct{}
+
+// allow returns a ticket if the request may go ahead.  Otherwise it
+// returns nil, along with how long until the breaker will try again.
+func (b *breaker) allow() (*ticket, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == BreakerOpen {
+		if wait := b.since.Add(b.cfg.OpenFor).Sub(now); wait > 0 {
+			b.rejected++
+			return nil, wait
+		}
+		b.setState(BreakerHalfOpen, now)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.trials >= b.cfg.Trials {
+			b.rejected++
+			return nil, 0
+		}
+		b.trials++
+		return &ticket{b: b, gen: b.gen, trial: true}, 0
+	}
+	return &ticket{b: b, gen: b.gen}, 0
+}
+
+// done records the outcome of the request.  Only the first call counts.
+func (t *ticket) done(failed bool, latency time.Duration) {
+	t.once.Do(func() { t.b.record(t, failed, latency) })
+}
+
+// release frees the ticket of a request whose outcome is unknown.
+func (t *ticket) release() {
+	t.once.Do(func() {
+		if !t.trial {
+			return
+		}
+		t.b.mu.Lock()
+		defer t.b.mu.Unlock()
+		if t.b.gen == t.gen {
+			t.b.trials--
+		}
+	})
+}
+
+// record counts the outcome of a request.  Trial requests only count
+// towards the half-open state they were admitted in.
+func (b *breaker) record(t *ticket, failed bool, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	slow := latency > b.cfg.SlowThreshold
+	switch b.state {
+	case BreakerHalfOpen:
+		if !t.trial || t.gen != b.gen {
+			return
+		}
+		if failed || slow {
+			b.trip(now)
+			return
+		}
+		if b.passed++; b.passed >= b.cfg.Trials {
+			b.setState(BreakerClosed, now)
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.cfg.Window {
+			b.windowStart = now
+			b.requests, b.failures, b.slow = 0, 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slow++
+		}
+		if b.requests >= b.cfg.MinRequests &&
+			(float64(b.failures) >= b.cfg.ErrorRate*float64(b.requests) ||
+				float64(b.slow) >= b.cfg.SlowRate*float64(b.requests)) {
+			b.trip(now)
+		}
+	}
+}
+
+// trip opens the breaker.  It must be called with the lock held.
+func (b *breaker) trip(now time.Time) {
+	b.trips++
+	b.setState(BreakerOpen, now)
+}
+
+// setState moves to a new state, starting the counts afresh.  It must be
+// called with the lock held.
+func (b *breaker) setState(s BreakerState, now time.Time) {
+	b.state, b.since, b.windowStart = s, now, now
+	b.gen++
+	b.requests, b.failures, b.slow = 0, 0, 0
+	b.trials, b.passed = 0, 0
+}
+
+// stats returns a snapshot of the breaker.
+func (b *breaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{State: b.state, Since: b.since, Requests: b.requests,
+		Failures: b.failures, Slow: b.slow, Trips: b.trips,
+		Rejected: b.rejected}
+}
+
+// breakerTransport reports the outcome of each request to the ticket in
+// its context, if there is one.
+type breakerTransport struct {
+	base http.RoundTripper
+}
+
+func (bt breakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := bt.base.RoundTrip(r)
+	if t, ok := r.Context().Value(ticketKey{}).(*ticket); ok {
+		if failed, known := backendFailed(resp, err); known {
+			t.done(failed, time.Since(start))
+		} else {
+			t.release()
+		}
+	}
+	return resp, err
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			if failing.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+	defer backend.Close()
+
+	b, err := limiter.NewBucketLimiter(1, limiter.Min, 10)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	ls := NewLimiterServer(8080, b, 10*time.Millisecond, backend.URL,
+		WithCircuitBreaker(BreakerConfig{MinRequests: 4, ErrorRate: 0.5,
+			OpenFor: 200 * time.Millisecond, Trials: 2}))
+	h := ls.enforceLimits(http.HandlerFunc(ls.proxyHandler))
+	send := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+		return w.Code
+	}
+
+	// Four failures open the breaker.
+	for i := 0; i < 4; i++ {
+		if code := send(); code != http.StatusInternalServerError {
+			t.Fatalf("%d: unexpected status %d", i, code)
+		}
+	}
+	if st := ls.breaker.stats(); st.State != BreakerOpen || st.Trips != 1 {
+		t.Fatalf("expected the breaker to be open: %+v", st)
+	}
+
+	// While open, requests fail fast and their tokens are refunded.
+	before, _ := limiter.StateOf(b)
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", code)
+	}
+	after, _ := limiter.StateOf(b)
+	if hits.Load() != 4 || after.Tokens < before.Tokens {
+		t.Fatalf("expected a refund without a backend call: %d, %v, %v",
+			hits.Load(), before.Tokens, after.Tokens)
+	}
+	if st := ls.Stats(); st.Admitted != 4 || st.Breaker == nil ||
+		st.Breaker.State != BreakerOpen || st.Breaker.Rejected != 1 {
+		t.Fatalf("expected the shed request not to be admitted: %+v", st)
+	}
+
+	// Once half-open, successful trials close it again.
+	time.Sleep(250 * time.Millisecond)
+	failing.Store(false)
+	for i := 0; i < 2; i++ {
+		if code := send(); code != http.StatusOK {
+			t.Fatalf("%d: unexpected status %d", i, code)
+		}
+	}
+	if st := ls.breaker.stats(); st.State != BreakerClosed ||
+		st.Rejected != 1 {
+		t.Fatalf("expected the breaker to be closed: %+v", st)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// CostMode determines how many tokens a request is charged.
+type CostMode int
+
+// Cost mode constants.  CostRequest charges one token per request, no
+// matter how large it is.  CostBytes charges one token per byte of the
+// request body, which is the byte-weighted form of the Token Bucket
+// algorithm.  In that mode, the limiter's rate and burst are expressed
+// in bytes, and bodies larger than the burst are rejected outright.
+const (
+	CostRequest CostMode = iota
+	CostBytes
+)
+
+// Errors surfaced while streaming a metered body to the proxied service.
+var (
+	errBodyTooLarge = errors.New("request body exceeds burst size")
+	errTooBusy      = errors.New("system too busy")
+)
+
+// A busyError is errTooBusy, along with the limiter that ran out of
+// tokens for part of a metered body, and the number it was short of, so
+// that the client can be told when to retry.
+type busyError struct {
+	limiter limiter.Limiter
+	tokens  int
+}
+
+func (e *busyError) Error() string {
+	return errTooBusy.Error()
+}
+
+func (e *busyError) Is(target error) bool {
+	return target == errTooBusy
+}
+
+// meteredBody charges tokens for the bytes of a request body as they
+// are read, for bodies whose length isn't known up front.
+type meteredBody struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	limiter limiter.Limiter
+	timeout time.Duration
+	burst   int
+	total   int
+}
+
+func (mb *meteredBody) Read(p []byte) (int, error) {
+	n, err := mb.body.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	mb.total += n
+	if mb.burst > 0 && mb.total > mb.burst {
+		return 0, errBodyTooLarge
+	}
+	res, aerr := limiter.AcquireTokens(mb.ctx, mb.limiter, n, mb.timeout)
+	if aerr != nil || !res {
+		return 0, &busyError{limiter: mb.limiter, tokens: n}
+	}
+	return n, err
+}
+
+func (mb *meteredBody) Close() error {
+	return mb.body.Close()
+}
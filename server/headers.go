@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// Every response to a limited request, whether it was admitted, turned
+// away by the limiter, or failed fast after being charged, carries the
+// RateLimit-Limit, -Remaining and -Reset headers from the IETF draft
+// "RateLimit header fields for HTTP", so that clients can pace
+// themselves.  With a token bucket, the limit is the burst size, the
+// remaining count is the number of whole tokens left, and the reset is
+// the number of seconds until the bucket is full again.  Rejections also
+// carry a Retry-After header, giving the number of seconds until the
+// request's tokens will have accrued, and describe the problem in an RFC
+// 7807 JSON body.  The backend's own RateLimit headers are dropped from
+// its responses to such requests, so that the client sees one set.
+//
+// The headers are only set for limiters that can report their state, as
+// requests under no limit have nothing to report, and their responses
+// keep whatever RateLimit headers the backend set.
+
+// rateLimitHeaders are the headers set from the state of a limiter.
+var rateLimitHeaders = []string{"RateLimit-Limit", "RateLimit-Remaining",
+	"RateLimit-Reset"}
+
+// limiterKey is the context key of the limiter that charged a forwarded
+// request.
+type limiterKey struct{}
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// setRateLimitHeaders sets the RateLimit headers from the state of the
+// limiter.
+func setRateLimitHeaders(h http.Header, lim limiter.Limiter) {
+	st, ok := limiter.StateOf(lim)
+	if !ok {
+		return
+	}
+	remaining := math.Floor(st.Tokens)
+	if remaining < 0 {
+		remaining = 0
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(st.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	h.Set("RateLimit-Reset", strconv.Itoa(secondsUntil(st,
+		float64(st.Burst))))
+}
+
+// dropBackendRateLimit removes the backend's RateLimit headers from its
+// response to a request whose own have been set.
+func dropBackendRateLimit(resp *http.Response) error {
+	lim, _ := resp.Request.Context().Value(limiterKey{}).(limiter.Limiter)
+	if _, ok := limiter.StateOf(lim); ok {
+		for _, h := range rateLimitHeaders {
+			resp.Header.Del(h)
+		}
+	}
+	return nil
+}
+
+// reject turns the request away, telling the client when it would be
+// worth coming back for the given number of tokens.
+func (ls *LimiterServer) reject(w http.ResponseWriter, lim limiter.Limiter,
+	cost int) {
+	retry := 0
+	if st, ok := limiter.StateOf(lim); ok {
+		retry = secondsUntil(st, float64(cost))
+	}
+	ls.turnAway(w, lim, retry)
+}
+
+// turnAway counts the request as rejected, and answers it with the
+// state of its limiter, if any, and the number of seconds after which it
+// would be worth retrying, of at least one.
+func (ls *LimiterServer) turnAway(w http.ResponseWriter, lim limiter.Limiter,
+	retry int) {
+	ls.rejected.Add(1)
+	setRateLimitHeaders(w.Header(), lim)
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeProblem(w, ls.rejectStatus, "System too busy", retry)
+}
+
+// writeProblem writes an RFC 7807 problem details response.
+func writeProblem(w http.ResponseWriter, status int, detail string,
+	retry int) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{Type: "about:blank",
+		Title: http.StatusText(status), Status: status, Detail: detail,
+		RetryAfter: retry})
+}
+
+// secondsUntil returns the number of whole seconds until the bucket
+// holds the given number of tokens.
+func secondsUntil(st limiter.State, tokens float64) int {
+	missing := tokens - st.Tokens
+	if missing <= 0 || st.Rate <= 0 {
+		return 0
+	}
+	return int(math.Ceil(missing / st.Rate))
+}
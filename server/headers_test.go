@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	// One token every 30 seconds.
+	b, err := limiter.NewBucketLimiter(2, limiter.Min, 2)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, 10*time.Millisecond, "http://dummy",
+		WithRejectStatus(http.StatusTooManyRequests))
+	h := server.enforceLimits(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, tc := range []struct {
+		status    int
+		remaining string
+		reset     string
+		retry     string
+	}{
+		{status: http.StatusOK, remaining: "1", reset: "30"},
+		{status: http.StatusOK, remaining: "0", reset: "60"},
+		{status: http.StatusTooManyRequests, remaining: "0", reset: "60",
+			retry: "30"},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+		hdr := w.Header()
+		if w.Code != tc.status || hdr.Get("RateLimit-Limit") != "2" ||
+			hdr.Get("RateLimit-Remaining") != tc.remaining ||
+			hdr.Get("RateLimit-Reset") != tc.reset ||
+			hdr.Get("Retry-After") != tc.retry {
+			t.Fatalf("%d: unexpected response %d: %v", i, w.Code, hdr)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+	var p problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatalf("Decoding problem failed: %v", err)
+	}
+	if w.Header().Get("Content-Type") != "application/problem+json" ||
+		p.Status != http.StatusTooManyRequests || p.RetryAfter != 30 {
+		t.Fatalf("unexpected problem: %+v", p)
+	}
+}
+
+// Test that the headers replace the backend's own, and that requests
+// shed after being charged carry them too.
+func TestRateLimitHeadersForwarded(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("RateLimit-Limit", "99")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+	defer backend.Close()
+
+	b, err := limiter.NewBucketLimiter(2, limiter.Min, 2)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, 10*time.Millisecond, backend.URL,
+		WithBackpressure(BackpressureConfig{}))
+
+	// The backend's answer pauses forwarding, so the second request is
+	// shed, and refunded.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/events",
+			nil))
+		hdr := w.Header()
+		if v := hdr.Values("RateLimit-Limit"); len(v) != 1 || v[0] != "2" ||
+			hdr.Get("RateLimit-Remaining") != "1" {
+			t.Fatalf("%d: unexpected headers %v", i, hdr)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The server answers liveness and readiness probes on the public port:
+//
+//	GET /healthz    200 for as long as the server is serving requests
+//	GET /readyz     200 if it is fit to take traffic, 503 otherwise
+//
+// The server is ready when its token servers are running, it isn't
+// shutting down, and, if a backend probe is configured, at least one
+// backend of the proxied service answered the last probe with a status
+// below 500.  Backends that fail the probe are taken out of rotation.
+// On shutdown, the server reports itself not ready before the listener
+// is closed, so that an orchestrator can stop routing traffic to it
+// first.
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// defaultProbeInterval is how often the backends are probed if no
+// interval is given.
+const defaultProbeInterval = 10 * time.Second
+
+// readiness is the body of a readiness response, which lists the outcome
+// of each check.
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthz reports that the server is alive.
+func (ls *LimiterServer) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether the server is ready to take traffic.
+func (ls *LimiterServer) readyz(w http.ResponseWriter, r *http.Request) {
+	res := readiness{Status: "ready", Checks: make(map[string]string)}
+
+	ls.servingMu.Lock()
+	running := ls.runCtx != nil && ls.runCtx.Err() == nil
+	ls.servingMu.Unlock()
+	res.Checks["limiter"] = "ok"
+	if !running {
+		res.Checks["limiter"] = "not running"
+		res.Status = "not ready"
+	}
+
+	if ls.draining.Load() {
+		res.Checks["shutdown"] = "draining"
+		res.Status = "not ready"
+	}
+
+	if ls.probePath != "" {
+		if msg, ok := ls.backendReadiness(); ok {
+			res.Checks["backend"] = msg
+		} else {
+			res.Checks["backend"] = msg
+			res.Status = "not ready"
+		}
+	}
+
+	status := http.StatusOK
+	if res.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, res)
+}
+
+// backendReadiness sums up the probes of the backends.  The server is
+// ready as long as any one of them is healthy.
+func (ls *LimiterServer) backendReadiness() (string, bool) {
+	var healthy int
+	var firstErr error
+	for _, b := range ls.pool.backends {
+		probed, err := b.probeState()
+		switch {
+		case !probed:
+			err = errors.New("not probed yet")
+		case err == nil:
+			healthy++
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if n := len(ls.pool.backends); n > 1 {
+		return fmt.Sprintf("%d/%d healthy", healthy, n), healthy > 0
+	}
+	if healthy == 0 {
+		return firstErr.Error(), false
+	}
+	return "ok", true
+}
+
+// probeBackends probes each of the backends at the configured interval,
+// starting straight away.  It is a blocking call that returns once the
+// context is canceled.
+func (ls *LimiterServer) probeBackends(ctx context.Context) {
+	t := time.NewTicker(ls.probeInterval)
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range ls.pool.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				b.setProbe(ls.probe(ctx, b))
+			}(b)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probe sends a GET for the probe path to the backend.  Any response
+// with a status below 500 counts as healthy, as it shows the backend
+// is up and handling requests.
+func (ls *LimiterServer) probe(ctx context.Context, b *backend) error {
+	if b.target == nil {
+		return fmt.Errorf("invalid backend URL %s", b.URL)
+	}
+	ref, err := url.Parse(ls.probePath)
+	if err != nil {
+		return err
+	}
+
+	// Don't let a probe outlast the interval, or they'd pile up.
+	ctx, cancel := context.WithTimeout(ctx, ls.probeInterval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		b.target.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ls.proxiedService.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("backend returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/ping" || !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+	defer backend.Close()
+
+	ls := NewLimiterServer(8080, nil, 10*time.Millisecond, backend.URL,
+		WithBackendProbe("/ping", time.Second))
+	ready := func() (int, readiness) {
+		w := httptest.NewRecorder()
+		ls.readyz(w, httptest.NewRequest("GET", readyPath, nil))
+		var res readiness
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("Decoding readiness failed: %v", err)
+		}
+		return w.Code, res
+	}
+
+	// Not running and not yet probed.
+	if code, res := ready(); code != http.StatusServiceUnavailable ||
+		res.Checks["limiter"] != "not running" ||
+		res.Checks["backend"] != "not probed yet" {
+		t.Fatalf("unexpected readiness %d: %+v", code, res)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	be := ls.pool.backends[0]
+	ls.servingMu.Lock()
+	ls.runCtx = ctx
+	ls.servingMu.Unlock()
+	be.setProbe(ls.probe(ctx, be))
+	if code, res := ready(); code != http.StatusOK || res.Status != "ready" {
+		t.Fatalf("unexpected readiness %d: %+v", code, res)
+	}
+
+	healthy.Store(false)
+	be.setProbe(ls.probe(ctx, be))
+	if code, res := ready(); code != http.StatusServiceUnavailable ||
+		res.Checks["backend"] != "backend returned 503" {
+		t.Fatalf("unexpected readiness %d: %+v", code, res)
+	}
+
+	healthy.Store(true)
+	be.setProbe(ls.probe(ctx, be))
+	ls.draining.Store(true)
+	if code, res := ready(); code != http.StatusServiceUnavailable ||
+		res.Checks["shutdown"] != "draining" {
+		t.Fatalf("unexpected readiness %d: %+v", code, res)
+	}
+
+	// Liveness doesn't depend on any of this.
+	w := httptest.NewRecorder()
+	ls.healthz(w, httptest.NewRequest("GET", healthPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected liveness %d", w.Code)
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Idempotency keys let a client retry a request that timed out, or was
+// turned away, without the risk of it being carried out twice.  The
+// client sends a key of its own making with the request, and the same
+// key with each retry of it.  The first response forwarded from the
+// backend under a key is remembered, for the time to live, and replayed
+// to any request from the same client with the same method, path and
+// key, without charging it tokens or forwarding it again.  The client is
+// the one the request's policy keys its limits by, or else the client's
+// IP address, so that a key can't be used to fetch another client's
+// response.  A request that reuses a key with a different body is
+// answered with a 422, as it is a mistake rather than a retry, and while
+// the first request is still under way, duplicates are answered with a
+// 409, as they can't yet be told what happened to it.
+//
+// Only the backend's answers are remembered, bar those saying it was
+// overloaded, so that a request turned away by the limiter, or one that
+// failed on its way to the backend, can be retried for real.
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+	maxIdempotencyKey = 255
+	maxReplayBody     = 1 << 20
+)
+
+// Defaults for the idempotency cache.
+const (
+	defaultIdempotencyTTL     = 24 * time.Hour
+	defaultIdempotencyEntries = 10000
+)
+
+// IdempotencyStats gives the number of responses remembered, and the
+// number of duplicate requests answered from them.
+type IdempotencyStats struct {
+	Entries  int    `json:"entries"`
+	Replayed uint64 `json:"replayed"`
+}
+
+// An idempotencyCache maps keys to responses, forgetting them once they
+// expire, or the oldest first once it is full.
+type idempotencyCache struct {
+	ttl        time.Duration
+	maxEntries int
+	replayed   atomic.Uint64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   list.List // of *replay, oldest first
+}
+
+// A replay is a remembered response, or a placeholder for one while the
+// first request under its key is under way.
+type replay struct {
+	key     string
+	expires time.Time
+	done    bool
+	request [sha256.Size]byte // the hash of the request body
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+func newIdempotencyCache(ttl time.Duration, maxEntries int) *idempotencyCache {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultIdempotencyEntries
+	}
+	return &idempotencyCache{ttl: ttl, maxEntries: maxEntries,
+		entries: make(map[string]*list.Element)}
+}
+
+// begin looks the key up.  If there is a response for it, it is
+// returned, and if not, a placeholder is made for it, which the caller
+// must either complete with finish, or drop with forget.  If a request
+// with the key is already under way, it returns false.
+func (c *idempotencyCache) begin(key string, now time.Time) (*replay, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+	if el, ok := c.entries[key]; ok {
+		rp := el.Value.(*replay)
+		return rp, rp.done
+	}
+	for len(c.entries) >= c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	c.entries[key] = c.order.PushBack(&replay{key: key,
+		expires: now.Add(c.ttl)})
+	return nil, true
+}
+
+// finish remembers the response for the key, along with the hash of the
+// request body, for the time to live.
+func (c *idempotencyCache) finish(key string, request [sha256.Size]byte,
+	status int, header http.Header, body []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		// It has already been evicted.
+		return
+	}
+	rp := el.Value.(*replay)
+	rp.done, rp.request = true, request
+	rp.status, rp.header, rp.body = status, header, body
+	rp.expires = now.Add(c.ttl)
+	c.order.MoveToBack(el)
+}
+
+// forget drops the placeholder for the key, if it is still one, so that
+// the request can be retried.
+func (c *idempotencyCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok && !el.Value.(*replay).done {
+		c.remove(el)
+	}
+}
+
+// expire drops the entries that have expired.  As they all live as long,
+// they expire in order.  It must be called with the lock held.
+func (c *idempotencyCache) expire(now time.Time) {
+	for el := c.order.Front(); el != nil; el = c.order.Front() {
+		if now.Before(el.Value.(*replay).expires) {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+func (c *idempotencyCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*replay).key)
+	c.order.Remove(el)
+}
+
+// stats returns the number of entries, and of requests replayed.
+func (c *idempotencyCache) stats() IdempotencyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return IdempotencyStats{Entries: len(c.entries),
+		Replayed: c.replayed.Load()}
+}
+
+// replayable reports whether a response is worth remembering: it must
+// have come from the backend, which must not have been overloaded.
+func replayable(status int, forwarded bool) bool {
+	return forwarded && status != 0 &&
+		status != http.StatusTooManyRequests &&
+		status < http.StatusInternalServerError
+}
+
+// forwardedKey is the context key of the flag set by poolTransport once a
+// request has been answered by a backend.
+type forwardedKey struct{}
+
+// idempotent answers requests that carry an idempotency key that has
+// been seen before with the response to the first of them, before they
+// are charged any tokens.
+func (ls *LimiterServer) idempotent(next http.Handler) http.Handler {
+	if ls.idempotency == nil {
+		return next
+	}
+	c := ls.idempotency
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeProblem(w, http.StatusBadRequest,
+				"Idempotency key too long", 0)
+			return
+		}
+		client := ls.policyFor(r).keyOf(r)
+		if client == "" {
+			client = ls.clientKey(r)
+		}
+		key = strings.Join([]string{client, r.Method, r.URL.Path, key}, " ")
+		rp, ok := c.begin(key, time.Now())
+		switch {
+		case !ok:
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusConflict,
+				"A request with this idempotency key is in progress", 1)
+			return
+		case rp != nil:
+			hb := newHashingBody(r)
+			io.Copy(io.Discard, hb)
+			if sum, _ := hb.sum(); sum != rp.request {
+				writeProblem(w, http.StatusUnprocessableEntity,
+					"Idempotency key reused with a different request", 0)
+				return
+			}
+			c.replayed.Add(1)
+			if e := entryOf(r.Context()); e != nil {
+				e.Decision = DecisionReplayed
+			}
+			h := w.Header()
+			for k, v := range rp.header {
+				h[k] = append([]string(nil), v...)
+			}
+			h.Set(replayedHeader, "true")
+			h.Set("Content-Length", strconv.Itoa(len(rp.body)))
+			w.WriteHeader(rp.status)
+			w.Write(rp.body)
+			return
+		}
+
+		// The placeholder is dropped unless the response is remembered,
+		// even if the proxy aborts the response with a panic.
+		defer c.forget(key)
+		var forwarded atomic.Bool
+		hb := newHashingBody(r)
+		r.Body = hb
+		rw := &recordingWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(),
+			forwardedKey{}, &forwarded)))
+		sum, read := hb.sum()
+		if rw.overflow || !read || !replayable(rw.status, forwarded.Load()) {
+			return
+		}
+		// The request ID, and the length, are those of the replay.
+		header := w.Header().Clone()
+		header.Del(requestIDHeader)
+		header.Del("Content-Length")
+		c.finish(key, sum, rw.status, header, rw.body.Bytes(), time.Now())
+	})
+}
+
+// recordingWriter keeps a copy of the response, so that it can be
+// replayed, unless it's too large to be worth keeping.
+type recordingWriter struct {
+	statusWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if !rw.overflow {
+		if rw.body.Len()+len(p) > maxReplayBody {
+			rw.overflow = true
+			rw.body = bytes.Buffer{}
+		} else {
+			rw.body.Write(p)
+		}
+	}
+	return rw.statusWriter.Write(p)
+}
+
+// hashingBody hashes a request body as it is read, so that a retry can be
+// told apart from a request reusing its key, without holding the body in
+// memory.
+type hashingBody struct {
+	io.ReadCloser
+
+	mu   sync.Mutex // the transport may still be reading
+	hash hash.Hash
+	eof  bool
+}
+
+func newHashingBody(r *http.Request) *hashingBody {
+	hb := &hashingBody{ReadCloser: r.Body, hash: sha256.New()}
+	if r.Body == nil || r.ContentLength == 0 {
+		// The proxy doesn't read empty bodies.
+		hb.ReadCloser, hb.eof = http.NoBody, true
+	}
+	return hb
+}
+
+func (hb *hashingBody) Read(p []byte) (int, error) {
+	n, err := hb.ReadCloser.Read(p)
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hb.hash.Write(p[:n])
+	if err == io.EOF {
+		hb.eof = true
+	}
+	return n, err
+}
+
+// sum returns the hash of the body, and whether all of it has been read.
+func (hb *hashingBody) sum() ([sha256.Size]byte, bool) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	var sum [sha256.Size]byte
+	hb.hash.Sum(sum[:0])
+	return sum, hb.eof
+}
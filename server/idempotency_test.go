@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+func TestIdempotency(t *testing.T) {
+	var hits atomic.Int32
+	block := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			n := hits.Add(1)
+			switch r.URL.Path {
+			case "/slow":
+				<-block
+			case "/busy":
+				if n == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			}
+			w.Header().Set("Location", "/events/"+strings.Repeat("1", int(n)))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("stored"))
+		}))
+	defer backend.Close()
+
+	b, err := limiter.NewBucketLimiter(100, limiter.Min, 100)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, time.Second, backend.URL,
+		WithRoutes("/"), WithIdempotency(time.Minute, 0))
+	sendFrom := func(remote, path, key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.RemoteAddr = remote
+		if key != "" {
+			r.Header.Set(idempotencyHeader, key)
+		}
+		server.Handler().ServeHTTP(w, r)
+		return w
+	}
+	send := func(path, key string) *httptest.ResponseRecorder {
+		return sendFrom("192.0.2.1:1234", path, key, "{}")
+	}
+
+	w := send("/events", "a")
+	if w.Code != http.StatusCreated || w.Header().Get(replayedHeader) != "" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	tokens := func() float64 {
+		st, _ := limiter.StateOf(b)
+		return st.Tokens
+	}
+	before := tokens()
+
+	// The retry gets the same response, without reaching the backend, or
+	// being charged.
+	w = send("/events", "a")
+	if w.Code != http.StatusCreated || w.Body.String() != "stored" ||
+		w.Header().Get("Location") != "/events/1" ||
+		w.Header().Get(replayedHeader) != "true" {
+		t.Fatalf("expected a replay, got %d %v %q", w.Code, w.Header(),
+			w.Body.String())
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected the retry not to be forwarded, got %d hits", n)
+	}
+	if after := tokens(); after < before-0.5 {
+		t.Fatalf("expected the retry to be free, went from %v to %v",
+			before, after)
+	}
+
+	// Reusing the key for another event is a mistake, not a retry.
+	if w := sendFrom("192.0.2.1:1234", "/events", "a",
+		`{"n": 2}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a changed body to be refused, got %d", w.Code)
+	}
+
+	// Other clients, keys and paths, and requests without a key, are
+	// forwarded.
+	if w := sendFrom("192.0.2.2:1234", "/events", "a",
+		"{}"); w.Header().Get(replayedHeader) != "" {
+		t.Fatalf("expected another client's response not to be replayed")
+	}
+	for _, tc := range []struct{ path, key string }{
+		{"/events", "b"}, {"/other", "a"}, {"/events", ""}, {"/events", ""},
+	} {
+		if w := send(tc.path, tc.key); w.Header().Get(replayedHeader) != "" {
+			t.Fatalf("%s %q: unexpected replay", tc.path, tc.key)
+		}
+	}
+	if n := hits.Load(); n != 6 {
+		t.Fatalf("expected 6 hits, got %d", n)
+	}
+
+	// An overloaded backend's answer isn't remembered.
+	hits.Store(0)
+	if w := send("/busy", "c"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a 503, got %d", w.Code)
+	}
+	if w := send("/busy", "c"); w.Code != http.StatusCreated ||
+		w.Header().Get(replayedHeader) != "" {
+		t.Fatalf("expected the retry to be forwarded, got %d", w.Code)
+	}
+
+	// A retry while the first attempt is under way is a conflict.
+	done := make(chan int)
+	go func() {
+		done <- send("/slow", "d").Code
+	}()
+	for hits.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if w := send("/slow", "d"); w.Code != http.StatusConflict {
+		t.Fatalf("expected a conflict, got %d", w.Code)
+	}
+	close(block)
+	if code := <-done; code != http.StatusCreated {
+		t.Fatalf("unexpected status %d", code)
+	}
+
+	if w := send("/events", strings.Repeat("k", 256)); w.Code !=
+		http.StatusBadRequest {
+		t.Fatalf("expected a long key to be refused, got %d", w.Code)
+	}
+	if st := server.Stats().Idempotency; st == nil || st.Entries != 6 ||
+		st.Replayed != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, 2)
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		if rp, ok := c.begin(key, now); rp != nil || !ok {
+			t.Fatalf("%s: expected a new entry", key)
+		}
+		c.finish(key, [32]byte{}, http.StatusOK, nil, nil, now)
+	}
+	// The oldest was evicted to make room.
+	if rp, _ := c.begin("a", now); rp != nil {
+		t.Fatalf("expected a to have been evicted")
+	}
+	c.forget("a")
+	if rp, ok := c.begin("c", now); rp == nil || !ok {
+		t.Fatalf("expected c to be replayed")
+	}
+
+	// Entries expire after the time to live.
+	if rp, _ := c.begin("c", now.Add(time.Minute)); rp != nil {
+		t.Fatalf("expected c to have expired")
+	}
+	if st := c.stats(); st.Entries != 1 {
+		t.Fatalf("expected only the new entry, got %+v", st)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// An IPSet is a set of networks, such as an allow or deny list, that can
+// hold thousands of prefixes and still be matched quickly.  It is a
+// binary trie over the bits of the addresses, so that a lookup takes at
+// most one step per bit, however many prefixes there are.  IPv4 and IPv6
+// networks are held in separate tries, as net.IPNet would match them, so
+// that an IPv6 prefix never covers IPv4 clients, even one such as ::/8
+// that spans the IPv4-mapped addresses.  An IPSet is read-only once
+// created, and so is safe for concurrent use.
+type IPSet struct {
+	v4, v6 trieNode
+	n      int
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	end   bool // a prefix ends here
+}
+
+// NewIPSet creates a set of the networks, in CIDR notation or as plain
+// IP addresses, as per ParseCIDRs.
+func NewIPSet(cidrs ...string) (*IPSet, error) {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		return nil, err
+	}
+	s := &IPSet{}
+	for _, n := range nets {
+		s.Add(n)
+	}
+	return s, nil
+}
+
+// LoadIPSet reads a set of networks from a file, one per line.  Blank
+// lines, and anything after a "#", are ignored.
+func LoadIPSet(file string) (*IPSet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cidrs []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return NewIPSet(cidrs...)
+}
+
+// Add adds a network to the set.  It must not be called once the set is
+// in use.
+func (s *IPSet) Add(n *net.IPNet) {
+	ones, bits := n.Mask.Size()
+	if bits == 0 {
+		return
+	}
+	root, ip := s.root(n.IP)
+	if ip == nil {
+		return
+	}
+	if bits == 8*net.IPv6len && len(ip) == net.IPv4len {
+		// An IPv4-mapped network counts as IPv4 if its mask only covers
+		// IPv4 addresses, as with net.IPNet.
+		if ones -= 8 * (net.IPv6len - net.IPv4len); ones < 0 {
+			root, ip = &s.v6, n.IP.To16()
+			ones += 8 * (net.IPv6len - net.IPv4len)
+		}
+	}
+
+	node := root
+	for i := 0; i < ones; i++ {
+		if node.end {
+			// A shorter prefix already covers the network.
+			return
+		}
+		b := bit(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = &trieNode{}
+		}
+		node = node.child[b]
+	}
+	if !node.end {
+		// The network covers any longer prefixes beneath it.
+		s.n -= node.count()
+		node.end = true
+		node.child = [2]*trieNode{}
+		s.n++
+	}
+}
+
+// count returns the number of prefixes ending at or beneath the node.
+func (t *trieNode) count() int {
+	if t == nil {
+		return 0
+	}
+	if t.end {
+		return 1
+	}
+	return t.child[0].count() + t.child[1].count()
+}
+
+// Contains reports whether the address is in one of the networks.  A nil
+// set contains nothing.
+func (s *IPSet) Contains(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+	node, ip := s.root(ip)
+	if ip == nil {
+		return false
+	}
+	for i := 0; node != nil; i++ {
+		if node.end {
+			return true
+		}
+		if i == 8*len(ip) {
+			break
+		}
+		node = node.child[bit(ip, i)]
+	}
+	return false
+}
+
+// root returns the trie for the address, and the address in the form
+// the trie holds it, or nil if it isn't valid.
+func (s *IPSet) root(ip net.IP) (*trieNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &s.v4, ip4
+	}
+	return &s.v6, ip.To16()
+}
+
+// Len returns the number of networks in the set, not counting those
+// that are covered by others.
+func (s *IPSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.n
+}
+
+// bit returns the i'th bit of the address, counting from the most
+// significant one.
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// clientIP returns the IP address of the client, as told by the trusted
+// proxies, if any, as per RemoteIPKey.
+func (ls *LimiterServer) clientIP(r *http.Request) net.IP {
+	return net.ParseIP(ls.clientKey(r))
+}
+
+// filterIPs turns away requests from the denied networks before they
+// can consume any tokens.  Requests from the allowed networks are given
+// a policy of their own by policyFor.
+func (ls *LimiterServer) filterIPs(next http.Handler) http.Handler {
+	if ls.denyList == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ls.denyList.Contains(ls.clientIP(r)) {
+			if e := entryOf(r.Context()); e != nil {
+				e.Decision = DecisionDenied
+			}
+			writeProblem(w, http.StatusForbidden, "Access denied", 0)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
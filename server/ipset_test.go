@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+func TestIPSet(t *testing.T) {
+	set, err := NewIPSet("10.0.0.0/8", "192.168.1.7", "2001:db8::/32",
+		"10.1.0.0/16", "::1")
+	if err != nil {
+		t.Fatalf("NewIPSet failed: %v", err)
+	}
+	if n := set.Len(); n != 4 {
+		t.Fatalf("expected 4 networks, got %d", n)
+	}
+	for ip, want := range map[string]bool{
+		"10.2.3.4":         true,
+		"11.0.0.1":         false,
+		"192.168.1.7":      true,
+		"192.168.1.8":      false,
+		"::ffff:10.0.0.1":  true,
+		"2001:db8:1::5":    true,
+		"2001:db9::1":      false,
+		"::1":              true,
+		"::2":              false,
+		"0.0.0.0":          false,
+		"ffff::ffff:0a0:1": false,
+	} {
+		if got := set.Contains(net.ParseIP(ip)); got != want {
+			t.Fatalf("%s: expected %t, got %t", ip, want, got)
+		}
+	}
+
+	// A wider network folds in the narrower ones.
+	_, n, _ := net.ParseCIDR("0.0.0.0/0")
+	set.Add(n)
+	if !set.Contains(net.ParseIP("8.8.8.8")) || set.Len() != 3 {
+		t.Fatalf("expected the IPv4 networks to be folded, got %d", set.Len())
+	}
+	if set.Contains(net.ParseIP("2001:db9::1")) || (*IPSet)(nil).Contains(
+		net.ParseIP("10.0.0.1")) {
+		t.Fatalf("unexpected match")
+	}
+
+	file := filepath.Join(t.TempDir(), "deny.txt")
+	os.WriteFile(file, []byte("# abusers\n203.0.113.0/24\n\n2001:db8::1 # one\n"),
+		0644)
+	if set, err := LoadIPSet(file); err != nil || set.Len() != 2 ||
+		!set.Contains(net.ParseIP("203.0.113.9")) {
+		t.Fatalf("LoadIPSet failed: %v", err)
+	}
+	// IPv6 networks don't cover IPv4 clients, but IPv4-mapped ones do.
+	set, _ = NewIPSet("::/8", "::ffff:198.51.100.0/120")
+	for ip, want := range map[string]bool{
+		"1.2.3.4":        false,
+		"::1":            true,
+		"198.51.100.7":   true,
+		"198.51.101.7":   false,
+		"::ffff:1.2.3.4": false,
+	} {
+		if got := set.Contains(net.ParseIP(ip)); got != want {
+			t.Fatalf("%s: expected %t, got %t", ip, want, got)
+		}
+	}
+
+	if _, err := NewIPSet("10.0.0.0/33"); err == nil {
+		t.Fatalf("expected an invalid network to be rejected")
+	}
+}
+
+// Test that denied clients are turned away without consuming tokens, and
+// that allowed ones aren't limited.
+func TestIPFilter(t *testing.T) {
+	b, err := limiter.NewBucketLimiter(1, limiter.Min, 1)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	deny, _ := NewIPSet("203.0.113.0/24", "2001:db8:bad::/48")
+	allow, _ := NewIPSet("10.0.0.0/8", "fd00::/8")
+	proxies, _ := ParseCIDRs("127.0.0.1")
+	server := NewLimiterServer(8080, b, 10*time.Millisecond, "http://dummy",
+		WithDenyList(deny), WithAllowList(allow, nil),
+		WithTrustedProxies(proxies...))
+	var x int64
+	ph := placeHolder{&x}
+	h := server.filterIPs(server.enforceLimits(
+		http.HandlerFunc(ph.eventHandler)))
+
+	for i, tc := range []struct {
+		remote, forwarded string
+		status            int
+	}{
+		{remote: "203.0.113.5:1000", status: http.StatusForbidden},
+		{remote: "[2001:db8:bad::1]:1000", status: http.StatusForbidden},
+		{remote: "127.0.0.1:1000", forwarded: "203.0.113.5",
+			status: http.StatusForbidden},
+		{remote: "10.1.2.3:1000", status: http.StatusOK},
+		{remote: "[fd00::1]:1000", status: http.StatusOK},
+		{remote: "10.1.2.3:1000", status: http.StatusOK},
+		// The denied requests left the one token for this one.
+		{remote: "198.51.100.1:1000", status: http.StatusOK},
+		{remote: "198.51.100.1:1000", status: http.StatusServiceUnavailable},
+	} {
+		r := httptest.NewRequest("POST", "/events", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Fatalf("%d: expected status %d, got %d", i, tc.status, w.Code)
+		}
+	}
+	if x != 4 {
+		t.Fatalf("expected 4 requests through, got %d", x)
+	}
+	// Allowed clients wait as long as the others.
+	if d := server.allowPolicy.waitTimeout(); d != 10*time.Millisecond {
+		t.Fatalf("expected the server's timeout, got %v", d)
+	}
+}
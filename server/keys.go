@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A KeyFunc identifies the client that a request comes from, so that
+// each client can be given a limiter of its own.  Requests for which no
+// key can be found all share the empty key.
+type KeyFunc func(r *http.Request) string
+
+// RemoteIPKey keys requests by the IP address of the client.  If the
+// connection comes from one of the trusted proxies, the X-Forwarded-For
+// header is walked from the right, and the first address that isn't a
+// trusted proxy is taken to be the client.  Otherwise the header is
+// ignored, as a client can put anything it likes in there.
+func RemoteIPKey(trusted ...*net.IPNet) KeyFunc {
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) string {
+		client := remoteIP(r)
+		if client == nil {
+			return ""
+		}
+		if len(trusted) == 0 || !isTrusted(client) {
+			return client.String()
+		}
+
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"),
+			","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			client = ip
+			if !isTrusted(ip) {
+				break
+			}
+		}
+		return client.String()
+	}
+}
+
+// HeaderKey keys requests by the value of the named header, such as one
+// carrying an API key.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// QueryKey keys requests by the value of the named query parameter.
+func QueryKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if r.URL == nil {
+			return ""
+		}
+		return r.URL.Query().Get(name)
+	}
+}
+
+// ParseCIDRs parses a list of networks in CIDR notation, such as the
+// trusted proxies for RemoteIPKey.  A plain IP address is taken to be
+// a network of one.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// remoteIP returns the IP address the request's connection came from,
+// or nil if it isn't known.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+func TestRemoteIPKey(t *testing.T) {
+	trusted, err := ParseCIDRs("10.0.0.0/8", "192.168.1.1")
+	if err != nil {
+		t.Fatalf("Parsing CIDRs failed: %v", err)
+	}
+	key := RemoteIPKey(trusted...)
+
+	for i, tc := range []struct {
+		remote string
+		xff    string
+		key    string
+	}{
+		// Untrusted peers can't spoof their address.
+		{remote: "1.2.3.4:5000", xff: "5.6.7.8", key: "1.2.3.4"},
+		{remote: "10.1.1.1:5000", key: "10.1.1.1"},
+		{remote: "10.1.1.1:5000", xff: "5.6.7.8", key: "5.6.7.8"},
+		{remote: "10.1.1.1:5000", xff: "9.9.9.9, 5.6.7.8, 192.168.1.1",
+			key: "5.6.7.8"},
+		{remote: "[2001:db8::1]:5000", key: "2001:db8::1"},
+	} {
+		r := httptest.NewRequest("GET", "/events", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if k := key(r); k != tc.key {
+			t.Fatalf("%d: expected key %s, got %s", i, tc.key, k)
+		}
+	}
+}
+
+// Test that a request waiting on a client's limiter when it's evicted to
+// make room for another client is turned away, rather than failed.
+func TestEvictedWhileWaiting(t *testing.T) {
+	reg := limiter.NewRegistry(func(string) (limiter.Limiter, error) {
+		return limiter.NewPulseLimiter(1, limiter.Min, 1)
+	}, 0, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reg.Run(ctx)
+	server := NewLimiterServer(8080, nil, 5*time.Second, "http://dummy",
+		WithKeyedLimits(reg, HeaderKey("X-API-Key")))
+	var x int64
+	ph := placeHolder{&x}
+	h := server.enforceLimits(http.HandlerFunc(ph.eventHandler))
+	send := func(key string) int {
+		r := httptest.NewRequest("POST", "/events", nil)
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := send("a"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	done := make(chan int)
+	go func() {
+		done <- send("a")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go send("b")
+	select {
+	case code := <-done:
+		if code != http.StatusServiceUnavailable {
+			t.Fatalf("expected the waiter to be turned away, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the waiter to be let go")
+	}
+	if st := server.Stats(); st.Rejected != 1 {
+		t.Fatalf("expected a rejection, got %+v", st)
+	}
+}
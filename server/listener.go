@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// protectedListener guards the server before a request ever gets as
+// far as the rate limiter.  It paces how fast new connections are
+// accepted, and caps the number of connections held open by any one
+// remote IP, so that a flood of idle or slow connections can't exhaust
+// the server.
+type protectedListener struct {
+	net.Listener
+	limiter  limiter.Limiter
+	maxPerIP int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// NewProtectedListener wraps the listener so that a token must be
+// acquired from the limiter for each connection accepted, and so that
+// no remote IP may hold more than maxPerIP connections at once.  Excess
+// connections are closed as soon as they are accepted.  A nil limiter
+// or non-positive maxPerIP disables the respective check.  If the
+// limiter has a token server, the caller is responsible for running it.
+func NewProtectedListener(l net.Listener, lim limiter.Limiter,
+	maxPerIP int) net.Listener {
+	pl := &protectedListener{Listener: l, limiter: lim, maxPerIP: maxPerIP,
+		conns: make(map[string]int)}
+	pl.ctx, pl.cancel = context.WithCancel(context.Background())
+	return pl
+}
+
+// Accept waits for a token before accepting the next connection, which
+// leaves connections that arrive too fast queued in the kernel backlog.
+func (pl *protectedListener) Accept() (net.Conn, error) {
+	for {
+		if pl.limiter != nil {
+			if _, err := pl.limiter.AcquireToken(pl.ctx, 0); err != nil {
+				if pl.ctx.Err() != nil {
+					return nil, net.ErrClosed
+				}
+				return nil, err
+			}
+		}
+
+		c, err := pl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ip, ok := pl.admit(c); ok {
+			return &trackedConn{Conn: c, release: func() { pl.release(ip) }}, nil
+		}
+		c.Close()
+	}
+}
+
+// Close closes the listener and releases an Accept waiting for a token.
+func (pl *protectedListener) Close() error {
+	pl.cancel()
+	return pl.Listener.Close()
+}
+
+// admit records the connection against its remote IP, and reports
+// whether that IP is still within its quota.
+func (pl *protectedListener) admit(c net.Conn) (string, bool) {
+	ip := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if pl.maxPerIP <= 0 {
+		return ip, true
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.conns[ip] >= pl.maxPerIP {
+		return ip, false
+	}
+	pl.conns[ip]++
+	return ip, true
+}
+
+func (pl *protectedListener) release(ip string) {
+	if pl.maxPerIP <= 0 {
+		return
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.conns[ip]--; pl.conns[ip] <= 0 {
+		delete(pl.conns, ip)
+	}
+}
+
+// trackedConn gives back its slot in the per-IP count when closed.
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (tc *trackedConn) Close() error {
+	tc.once.Do(tc.release)
+	return tc.Conn.Close()
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Test that connections beyond the per-IP cap are closed on accept,
+// and that closing a connection frees up its slot.
+func TestMaxConnsPerIP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	pl := NewProtectedListener(ln, nil, 1)
+	defer pl.Close()
+
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			c, err := pl.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		return c
+	}
+
+	first := dial()
+	defer first.Close()
+	c1 := <-accepted
+
+	// The second connection from the same IP is dropped.
+	second := dial()
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected second connection to be closed")
+	}
+	select {
+	case <-accepted:
+		t.Fatalf("second connection should not have been accepted")
+	default:
+	}
+
+	// Once the first goes away, there's room again.
+	c1.Close()
+	third := dial()
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("third connection was not accepted")
+	}
+
+	pl.Close()
+	if _, ok := <-accepted; ok {
+		t.Fatalf("expected Accept to fail after Close")
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// An Option configures optional behavior of a LimiterServer.  Options
+// are passed to NewLimiterServer, and the defaults reproduce the plain
+// one-token-per-request behavior.
+type Option func(*LimiterServer)
+
+// WithCostMode sets how many tokens each request is charged.
+func WithCostMode(mode CostMode) Option {
+	return func(ls *LimiterServer) {
+		ls.policy.cost = mode
+	}
+}
+
+// WithUploadLimiter paces the request bodies forwarded to the proxied
+// service, at one token per byte.  This protects the uplink from large
+// batch uploads, independently of how many requests are admitted.
+func WithUploadLimiter(l limiter.Limiter) Option {
+	return func(ls *LimiterServer) {
+		ls.upload = l
+	}
+}
+
+// WithDownloadLimiter paces the response bodies sent back to clients,
+// at one token per byte.
+func WithDownloadLimiter(l limiter.Limiter) Option {
+	return func(ls *LimiterServer) {
+		ls.download = l
+	}
+}
+
+// WithAcceptLimiter paces how fast new connections are accepted, at one
+// token per connection.
+func WithAcceptLimiter(l limiter.Limiter) Option {
+	return func(ls *LimiterServer) {
+		ls.acceptLimiter = l
+	}
+}
+
+// WithMaxConnsPerIP caps the number of connections any one remote IP
+// may hold open at once.  Zero, the default, means no cap.
+func WithMaxConnsPerIP(n int) Option {
+	return func(ls *LimiterServer) {
+		ls.maxConnsPerIP = n
+	}
+}
+
+// WithReadHeaderTimeout sets how long a client has to send the request
+// headers, which guards against slowloris-style attacks.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.readHeaderTimeout = d
+	}
+}
+
+// WithIdleTimeout sets how long an idle keep-alive connection is held
+// open waiting for the next request.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.idleTimeout = d
+	}
+}
+
+// WithRoutes sets the path prefixes that are forwarded to the proxied
+// service.  A prefix also covers the paths beneath it, so "/events"
+// forwards both "/events" and "/events/12345".
+func WithRoutes(prefixes ...string) Option {
+	return func(ls *LimiterServer) {
+		ls.routes = prefixes
+	}
+}
+
+// WithKeyedLimits gives each client its own limiter from the registry,
+// rather than sharing the one passed to NewLimiterServer, which may then
+// be nil.  The key function identifies the client of a request.
+func WithKeyedLimits(reg *limiter.Registry, key KeyFunc) Option {
+	return func(ls *LimiterServer) {
+		ls.policy.keyed = reg
+		ls.policy.key = key
+	}
+}
+
+// WithRules applies the limit policies of a rule set, such as one read
+// by LoadRules.  Requests that match none of the rules are limited by
+// the limiter passed to NewLimiterServer, or not at all if that is nil.
+func WithRules(rs *RuleSet) Option {
+	return func(ls *LimiterServer) {
+		ls.rules.Store(rs)
+	}
+}
+
+// WithRulesFile reads the rules from a JSON file when the server starts,
+// and reloads them whenever the file changes, or Reload is called, such
+// as on SIGHUP.  The file is checked for changes at the given interval,
+// or every five seconds if that is 0.  See Reload for how the new rules
+// are swapped in.
+func WithRulesFile(file string, poll time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.rulesFile = file
+		if poll > 0 {
+			ls.rulesPoll = poll
+		}
+	}
+}
+
+// WithAdminPort serves the admin API on a port of its own, apart from
+// the public one.  See the admin API description for what it offers.
+func WithAdminPort(port int) Option {
+	return func(ls *LimiterServer) {
+		ls.adminPort = port
+	}
+}
+
+// WithAdminHost sets the interface the admin API listens on, which is
+// the loopback one by default, so that it can't be reached from other
+// hosts.  An empty host means all interfaces.
+func WithAdminHost(host string) Option {
+	return func(ls *LimiterServer) {
+		ls.adminHost = host
+	}
+}
+
+// WithAdminAuth has every request to the admin API authenticate with
+// the authorizer, such as one made by AdminCredentials, and audits
+// changes with the user it returns.
+func WithAdminAuth(auth AdminAuthorizer) Option {
+	return func(ls *LimiterServer) {
+		ls.adminAuth = auth
+	}
+}
+
+// WithAuditLog writes a JSON line to the writer for every change made
+// through the admin API.  By default, changes go to the standard logger.
+func WithAuditLog(w io.Writer) Option {
+	return func(ls *LimiterServer) {
+		ls.auditLog = w
+	}
+}
+
+// WithRejectStatus sets the status code of the response to a request
+// that is turned away by the limiter, which is usually either 429 (Too
+// Many Requests) or 503 (Service Unavailable), the default.
+func WithRejectStatus(code int) Option {
+	return func(ls *LimiterServer) {
+		ls.rejectStatus = code
+	}
+}
+
+// WithBackendProbe has the server probe each backend of the proxied
+// service by sending a GET for the path at the given interval, or every
+// ten seconds if that is 0.  Backends that fail the probe are taken out
+// of rotation, and the server is only ready while any of them pass.
+func WithBackendProbe(path string, interval time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.probePath = path
+		if interval > 0 {
+			ls.probeInterval = interval
+		}
+	}
+}
+
+// WithShutdownDelay sets how long the server keeps serving after it
+// reports itself not ready on shutdown, which gives load balancers time
+// to notice before the listener is closed.  The default is no delay.
+func WithShutdownDelay(d time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.shutdownDelay = d
+	}
+}
+
+// WithCircuitBreaker stops forwarding requests to the proxied service
+// while it is failing, as per the configuration, whose zero values are
+// replaced by defaults.  See BreakerConfig for the details.
+func WithCircuitBreaker(cfg BreakerConfig) Option {
+	return func(ls *LimiterServer) {
+		ls.breaker = newBreaker(cfg)
+	}
+}
+
+// WithBackends forwards requests to several replicas of the proxied
+// service, spread over them as per the balance, in place of the proxied
+// URL passed to NewLimiterServer.  Combine with WithBackendProbe to take
+// unhealthy backends out of rotation.
+func WithBackends(balance Balance, backends ...Backend) Option {
+	return func(ls *LimiterServer) {
+		ls.pool = newPool(balance, backends...)
+	}
+}
+
+// WithPassiveHealth ejects a backend for a while once the given number
+// of requests in a row to it have failed, that is, it couldn't be
+// reached or returned a status of 500 or above.  The default is to
+// eject a backend for 30 seconds after 5 failures.
+func WithPassiveHealth(maxFails int, ejectFor time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.maxFails = maxFails
+		ls.ejectFor = ejectFor
+	}
+}
+
+// WithWaitQueue bounds the number of requests waiting for a token from
+// the limiter passed to NewLimiterServer, and serves them in the order
+// given by the queue discipline, as per limiter.NewQueue.  Once the
+// queue is full, further requests are turned away immediately.  For
+// keyed limits, wrap the limiters made by the registry's factory with
+// limiter.NewQueue instead.
+func WithWaitQueue(maxWaiters int, discipline limiter.Discipline,
+	target time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.queue = func(l limiter.Limiter) limiter.Limiter {
+			return limiter.NewQueue(l, maxWaiters, discipline, target)
+		}
+	}
+}
+
+// WithDrainTimeout sets how long requests in progress are given to
+// finish on shutdown, after which their connections are closed.  The
+// default is 30 seconds.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.drainTimeout = d
+	}
+}
+
+// WithMaxClientWait lets clients say how long they're prepared to wait
+// for a token, up to the given ceiling, with the X-RateLimit-Max-Wait or
+// Prefer: wait= headers.  Requests that don't say wait for the timeout
+// of their policy.  By default, clients have no say.
+func WithMaxClientWait(ceiling time.Duration) Option {
+	return func(ls *LimiterServer) {
+		ls.maxClientWait = ceiling
+	}
+}
+
+// WithTLS terminates TLS with the certificate and key in the given
+// files, reloading them whenever they change, and optionally verifies
+// client certificates against a CA bundle.  See TLSFiles.  The admin
+// API stays on plain HTTP.
+func WithTLS(files TLSFiles) Option {
+	return func(ls *LimiterServer) {
+		ls.certs = newCertStore(files)
+		ls.tlsConfig = ls.certs.config()
+	}
+}
+
+// WithTLSConfig terminates TLS with the given configuration, which must
+// provide a certificate, either directly or through GetCertificate.  It
+// suits certificates that are held in memory, rather than in files.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(ls *LimiterServer) {
+		ls.certs = nil
+		ls.tlsConfig = cfg
+	}
+}
+
+// WithAccessLog writes a JSON line to the writer for every request to
+// the limited routes, giving the limiter's decision and the outcome, as
+// described by AccessEntry.  The writer may be a RotatingFile, to keep
+// the log from growing without bound.
+func WithAccessLog(w io.Writer) Option {
+	return func(ls *LimiterServer) {
+		ls.accessLog = w
+	}
+}
+
+// WithShadowPolicy evaluates a candidate policy on every request, with
+// limiters of its own, recording what it would have decided without ever
+// enforcing it.  Should the policy be invalid, the server fails to start.
+func WithShadowPolicy(name string, pc PolicyConfig) Option {
+	return func(ls *LimiterServer) {
+		p, err := newPolicy(pc, nil)
+		if err != nil {
+			ls.shadowErr = fmt.Errorf("shadow policy %q: %v", name, err)
+			return
+		}
+		p.name = name
+		ls.shadowPolicies = append(ls.shadowPolicies, newShadow(p))
+	}
+}
+
+// WithDenyList turns away requests from the given networks with a 403,
+// before they can consume any tokens.
+func WithDenyList(set *IPSet) Option {
+	return func(ls *LimiterServer) {
+		ls.denyList = set
+	}
+}
+
+// WithAllowList charges requests from the given networks against a
+// limiter of their own, such as one with a higher limit, rather than
+// against the server's policies.  A nil limiter lets them through
+// without any limit.  They may wait as long for their tokens as other
+// requests under the server's own policy.  The deny list still applies
+// to them.
+func WithAllowList(set *IPSet, l limiter.Limiter) Option {
+	return func(ls *LimiterServer) {
+		ls.allowList = set
+		ls.allowPolicy = &policy{name: allowPolicy, limiter: l,
+			timeoutFrom: ls.policy}
+	}
+}
+
+// WithTrustedProxies gives the proxies whose X-Forwarded-For headers are
+// trusted to tell who the client is, for the allow and deny lists, as
+// per RemoteIPKey.  By default, the client is whoever connected.
+func WithTrustedProxies(nets ...*net.IPNet) Option {
+	return func(ls *LimiterServer) {
+		ls.trustedProxies = nets
+	}
+}
+
+// WithAdaptiveConcurrency caps the number of requests in flight to the
+// backends with a limit that adapts to their latency, on top of the rate
+// limits.  Requests over the limit are turned away with a 503, and have
+// their tokens refunded.  Failures and round trip times are fed back to
+// the limiter, and its current limit is shown by Stats.
+func WithAdaptiveConcurrency(a *limiter.AdaptiveLimiter) Option {
+	return func(ls *LimiterServer) {
+		ls.concurrency = a
+	}
+}
+
+// WithBackpressure forwards fewer requests to the proxied service while
+// it answers with a 429 or 503, and none at all for as long as it asks
+// with a Retry-After header, as per the configuration, whose zero values
+// are replaced by defaults.  See BackpressureConfig for the details.
+func WithBackpressure(cfg BackpressureConfig) Option {
+	return func(ls *LimiterServer) {
+		ls.backpressure = newBackpressure(cfg)
+	}
+}
+
+// WithIdempotency remembers the responses to requests carrying an
+// Idempotency-Key header for the time to live, up to the given number of
+// them, and replays them to retries of the requests, instead of charging
+// and forwarding them again.  Zero values mean a day, and 10000.
+func WithIdempotency(ttl time.Duration, maxEntries int) Option {
+	return func(ls *LimiterServer) {
+		ls.idempotency = newIdempotencyCache(ttl, maxEntries)
+	}
+}
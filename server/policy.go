@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// A policy decides which limiter a request is charged against, how many
+// tokens it costs, and how long it may wait for them.  The limiter is
+// either shared by all requests, or, if there is a registry, looked up
+// by the key that identifies the client.  Individual clients of a keyed
+// policy may be given a temporary override of their limits.
+type policy struct {
+	name    string
+	config  *PolicyConfig // nil unless it comes from a rule set, see limits
+	limiter limiter.Limiter
+	keyed   *limiter.Registry
+	key     KeyFunc
+	timeout time.Duration
+	cost    CostMode
+
+	// The policy whose timeout applies instead, if any, as read when
+	// the request comes.
+	timeoutFrom *policy
+
+	mu        sync.Mutex
+	overrides map[string]*override
+}
+
+// An override replaces the limiter of one client of a keyed policy until
+// it expires.  A nil limiter means the client isn't limited at all.
+type override struct {
+	limiter limiter.Limiter
+	expires time.Time
+}
+
+// waitTimeout returns how long requests may wait for their tokens.
+func (p *policy) waitTimeout() time.Duration {
+	if p.timeoutFrom != nil {
+		return p.timeoutFrom.timeout
+	}
+	return p.timeout
+}
+
+// keyOf returns the key of the client the request comes from, or the
+// empty key if the policy isn't keyed.
+func (p *policy) keyOf(r *http.Request) string {
+	if p.keyed == nil {
+		return ""
+	}
+	return p.key(r)
+}
+
+// limiterFor returns the limiter that requests with the given key are
+// charged against.  It is nil if they aren't limited at all.
+func (p *policy) limiterFor(key string) (limiter.Limiter, error) {
+	if p.keyed == nil {
+		return p.limiter, nil
+	}
+	if o := p.override(key); o != nil {
+		return o.limiter, nil
+	}
+	return p.keyed.Get(key)
+}
+
+// override returns the override in effect for the key, if any.
+func (p *policy) override(key string) *override {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	o := p.overrides[key]
+	if o != nil && time.Now().After(o.expires) {
+		delete(p.overrides, key)
+		o = nil
+	}
+	return o
+}
+
+// setOverride puts an override in place for the key, or removes it if
+// o is nil.
+func (p *policy) setOverride(key string, o *override) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if o == nil {
+		delete(p.overrides, key)
+		return
+	}
+	if p.overrides == nil {
+		p.overrides = make(map[string]*override)
+	}
+	p.overrides[key] = o
+}
+
+// limits returns the configuration of a policy that comes from a rule
+// set, as changed through the admin API since, or nil.
+func (p *policy) limits() *PolicyConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config
+}
+
+// update records the limits changed through the admin API in the
+// configuration of a policy that comes from a rule set.  The rule set
+// keeps the configuration it was loaded with, so that a reload only
+// replaces the policy if the file changed it.
+func (p *policy) update(upd limitUpdate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config == nil {
+		return
+	}
+	pc := *p.config
+	if upd.Rate != 0 {
+		pc.Rate, pc.Interval = upd.Rate, upd.Interval
+	}
+	if upd.Burst != 0 {
+		pc.Burst = upd.Burst
+	}
+	p.config = &pc
+}
+
+// keepOverrides carries over the overrides of the policy being replaced,
+// so that changing a policy doesn't undo the exceptions made for its
+// clients.
+func (p *policy) keepOverrides(old *policy) {
+	if p.keyed == nil {
+		return
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	for key, o := range old.overrides {
+		p.setOverride(key, o)
+	}
+}
+
+// serve runs the token servers of the policy's limiters.  It is a
+// blocking call that returns once the context is canceled.
+func (p *policy) serve(ctx context.Context) {
+	switch {
+	case p.keyed != nil:
+		p.keyed.Run(ctx)
+	case p.limiter != nil && p.limiter.HasTokenServer():
+		p.limiter.ServeTokens(ctx)
+	}
+}
+
+// requestCost works out how many tokens to charge up front for the
+// request.  In byte-cost mode, a body of unknown length is instead
+// metered as it is read, and the cost returned is 0.  If the request
+// can never be admitted, an error response is written and false is
+// returned.
+func (p *policy) requestCost(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, lim limiter.Limiter) (int, bool) {
+	if p.cost != CostBytes {
+		return 1, true
+	}
+
+	burst := limiter.Burst(lim)
+	if burst > 0 && r.ContentLength > int64(burst) {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return 0, false
+	}
+	switch {
+	case r.ContentLength > 0:
+		return int(r.ContentLength), true
+	case r.ContentLength < 0 && r.Body != nil:
+		r.Body = &meteredBody{ctx: ctx, body: r.Body, limiter: lim,
+			timeout: p.waitTimeout(), burst: burst}
+		return 0, true
+	default:
+		// Even an empty request costs something.
+		return 1, true
+	}
+}
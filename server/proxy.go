@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// defaultRoute is the path prefix forwarded when no routes are set.
+const defaultRoute = "/events"
+
+// newReverseProxy creates the proxy that forwards admitted requests to
+// the backends of the proxied service.  The method, path, query string,
+// headers and body of the request are passed through, and the response
+// comes back intact.  Hop-by-hop headers are dropped in both directions,
+// and the X-Forwarded-For, -Host and -Proto headers are set for the
+// backend.
+func (ls *LimiterServer) newReverseProxy() *httputil.ReverseProxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Duration(connTimeout) * time.Second
+	var rt http.RoundTripper = poolTransport{base: transport, pool: ls.pool,
+		bp: ls.backpressure}
+	if ls.breaker != nil {
+		rt = breakerTransport{base: rt}
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			b, _ := pr.In.Context().Value(backendKey{}).(*backend)
+			if b != nil && b.target != nil {
+				pr.SetURL(b.target)
+			}
+
+			// Keep any forwarding chain from proxies in front of us.
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			pr.SetXForwarded()
+		},
+		Transport:      rt,
+		ModifyResponse: dropBackendRateLimit,
+		ErrorHandler:   ls.proxyError,
+	}
+}
+
+// proxyHandler will be invoked to forward the request once it has
+// made it past the rate limiter.
+func (ls *LimiterServer) proxyHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if ls.upload != nil && r.Body != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{limiter.NewReader(r.Context(), r.Body, ls.upload), r.Body}
+	}
+	if ls.download != nil {
+		w = newThrottledResponseWriter(r.Context(), w, ls.download)
+	}
+
+	// The backend is normally picked as the request is admitted.
+	if _, ok := r.Context().Value(backendKey{}).(*backend); !ok {
+		b, err := ls.pool.pick(ls.probePath != "")
+		if err != nil {
+			ls.proxyError(w, r, err)
+			return
+		}
+		defer b.done()
+		r = r.WithContext(context.WithValue(r.Context(), backendKey{}, b))
+	}
+	ls.proxiedService.ServeHTTP(w, r)
+}
+
+// proxyError reports a failure to get a response from the proxied
+// service.  Errors raised while metering the request body are reported
+// as such, rather than as a problem with the service, and a body that
+// runs out of tokens has the request rejected like any other.
+func (ls *LimiterServer) proxyError(w http.ResponseWriter, r *http.Request,
+	err error) {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errTooBusy):
+		if e := entryOf(r.Context()); e != nil {
+			e.Decision = DecisionRejected
+		}
+		var be *busyError
+		if errors.As(err, &be) {
+			ls.reject(w, be.limiter, be.tokens)
+		} else {
+			ls.turnAway(w, nil, ls.pool.retryAfter())
+		}
+	default:
+		log.Printf("Proxied service error: %v\n", err)
+		http.Error(w, "Service error", http.StatusBadGateway)
+	}
+}
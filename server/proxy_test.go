@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// Test that requests and responses pass through the proxy intact.
+func TestProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Hop") != "" {
+				t.Errorf("hop-by-hop header was forwarded")
+			}
+			if r.Header.Get("X-Forwarded-For") == "" {
+				t.Errorf("X-Forwarded-For header is missing")
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Location", r.URL.Path+"/12345")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " +
+				r.Header.Get("X-Custom") + " " + string(body)))
+		}))
+	defer ts.Close()
+
+	b, err := limiter.NewBucketLimiter(100, limiter.Sec, 10)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, time.Second, ts.URL)
+	h := server.enforceLimits(http.HandlerFunc(server.proxyHandler))
+
+	r := httptest.NewRequest("PUT", "/events/7?x=1", strings.NewReader("hi"))
+	r.Header.Set("X-Custom", "value")
+	r.Header.Set("Connection", "X-Hop")
+	r.Header.Set("X-Hop", "dropped")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "/events/7/12345" {
+		t.Fatalf("unexpected location: %s", loc)
+	}
+	if body := w.Body.String(); body != "PUT /events/7?x=1 value hi" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	// A backend that's down is reported as a bad gateway.
+	ts.Close()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, w.Code)
+	}
+}
+
+// Test that the adaptive concurrency limit learns from the latency of the
+// backend, and sheds the requests over it.
+func TestAdaptiveConcurrency(t *testing.T) {
+	block := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-block
+			}
+			time.Sleep(5 * time.Millisecond)
+		}))
+	defer backend.Close()
+
+	b, err := limiter.NewBucketLimiter(100, limiter.Min, 100)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	// Anything over a millisecond is too slow.
+	a := limiter.NewAdaptiveLimiter(&limiter.AIMD{Threshold: time.Millisecond},
+		2, 1, 2)
+	server := NewLimiterServer(8080, b, time.Second, backend.URL,
+		WithRoutes("/"), WithAdaptiveConcurrency(a))
+	send := func(path string) int {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	if code := send("/fast"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if st := server.Stats().Concurrency; st == nil || st.Limit != 1 ||
+		st.Inflight != 0 {
+		t.Fatalf("expected the limit to come down to 1, got %+v", st)
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- send("/slow")
+	}()
+	for a.Inflight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if code := send("/fast"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the request to be shed, got %d", code)
+	}
+	close(block)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if st, ok := limiter.StateOf(b); !ok || st.Tokens < 97.5 {
+		t.Fatalf("expected the shed request to be refunded, got %+v", st)
+	}
+}
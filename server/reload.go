@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// defaultRulesPoll is how often the rules file is checked for changes.
+const defaultRulesPoll = 5 * time.Second
+
+// Reload re-reads the rules file given by WithRulesFile, and atomically
+// swaps in the new rules.  Policies whose settings haven't changed keep
+// their limiters, and so their current token counts.  If the new rules
+// are invalid, they are rejected and the current ones stay in effect.
+func (ls *LimiterServer) Reload() error {
+	if ls.rulesFile == "" {
+		return errors.New("no rules file configured")
+	}
+
+	// Serialize reloads, so that one can't overwrite a newer one.
+	ls.reloadMu.Lock()
+	defer ls.reloadMu.Unlock()
+
+	f, err := os.Open(ls.rulesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, err := readRules(f)
+	if err != nil {
+		return err
+	}
+	return ls.swapRules(cfg)
+}
+
+// swapRules compiles the configuration, reusing what it can of the rules
+// in effect, and swaps it in.  The reload lock must be held.
+func (ls *LimiterServer) swapRules(cfg RulesConfig) error {
+	rs, err := newRuleSet(cfg, ls.currentRules())
+	if err != nil {
+		return err
+	}
+
+	ls.rules.Store(rs)
+	ls.servePolicies()
+	return nil
+}
+
+// currentRules returns the rule set in effect, if any.
+func (ls *LimiterServer) currentRules() *RuleSet {
+	rs, _ := ls.rules.Load().(*RuleSet)
+	return rs
+}
+
+// watchRules reloads the rules whenever the file changes.  It is a
+// blocking call that returns once the context is canceled.
+func (ls *LimiterServer) watchRules(ctx context.Context) {
+	t := time.NewTicker(ls.rulesPoll)
+	defer t.Stop()
+
+	var last os.FileInfo
+	if fi, err := os.Stat(ls.rulesFile); err == nil {
+		last = fi
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		fi, err := os.Stat(ls.rulesFile)
+		if err != nil || (last != nil && fi.ModTime().Equal(last.ModTime()) &&
+			fi.Size() == last.Size()) {
+			continue
+		}
+		last = fi
+		if err := ls.Reload(); err != nil {
+			log.Printf("Rules in %s rejected: %v\n", ls.rulesFile, err)
+		} else {
+			log.Printf("Rules reloaded from %s\n", ls.rulesFile)
+		}
+	}
+}
+
+// servePolicies runs the token servers for any policies that have come
+// into use, and stops those of the policies that are no longer in use.
+// It does nothing unless the server is running.
+func (ls *LimiterServer) servePolicies() {
+	ls.servingMu.Lock()
+	defer ls.servingMu.Unlock()
+	if ls.runCtx == nil || ls.runCtx.Err() != nil {
+		return
+	}
+
+	current := make(map[*policy]bool)
+	for _, p := range ls.policies() {
+		current[p] = true
+		if _, ok := ls.serving[p]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(ls.runCtx)
+		ls.serving[p] = cancel
+		ls.runWg.Add(1)
+		go func(p *policy) {
+			defer ls.runWg.Done()
+
+			p.serve(ctx)
+		}(p)
+	}
+	for p, cancel := range ls.serving {
+		if !current[p] {
+			cancel()
+			delete(ls.serving, p)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const reloadRules = `{
+  "policies": {
+    "a": {"algorithm": "bucket", "rate": 1, "interval": "min", "burst": 1,
+          "timeout": "10ms"},
+    "b": {"algorithm": "bucket", "rate": 1, "interval": "min", "burst": %d,
+          "timeout": "10ms"}
+  },
+  "rules": [
+    {"path": "/a", "policy": "a"},
+    {"path": "/b", "policy": "b"}
+  ]
+}`
+
+// Test that a reload keeps the state of unchanged policies, and that
+// invalid rules are rejected.
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatalf("Creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules.json")
+	write := func(rules string) {
+		if err := ioutil.WriteFile(file, []byte(rules), 0644); err != nil {
+			t.Fatalf("Writing rules failed: %v", err)
+		}
+	}
+
+	write(fmt.Sprintf(reloadRules, 1))
+	server := NewLimiterServer(8080, nil, time.Second, "http://dummy",
+		WithRulesFile(file, 0))
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Loading rules failed: %v", err)
+	}
+	var x int64
+	ph := placeHolder{&x}
+	h := server.enforceLimits(http.HandlerFunc(ph.eventHandler))
+	admitted := func(path string) bool {
+		before := x
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		return x > before
+	}
+
+	if !admitted("/a") || !admitted("/b") {
+		t.Fatalf("expected initial requests to be admitted")
+	}
+
+	// Policy "b" changes and starts afresh, while "a" stays exhausted.
+	write(fmt.Sprintf(reloadRules, 2))
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reloading rules failed: %v", err)
+	}
+	if admitted("/a") {
+		t.Fatalf("expected unchanged policy to keep its state")
+	}
+	if !admitted("/b") || !admitted("/b") || admitted("/b") {
+		t.Fatalf("expected changed policy to have a fresh bucket of 2")
+	}
+
+	// Bad rules leave the current ones in place.
+	write(`{"policies": {"a": {"rate": -1, "burst": 1}}}`)
+	if err := server.Reload(); err == nil {
+		t.Fatalf("expected invalid rules to be rejected")
+	}
+	if admitted("/a") || admitted("/b") {
+		t.Fatalf("expected the previous rules to remain in effect")
+	}
+}
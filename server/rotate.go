@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file that is rotated once it reaches a maximum
+// size: the file is renamed with a ".1" suffix, any older ones move up
+// by one, and a fresh file is started.  At most the given number of old
+// files are kept, with the oldest one being removed.  It is safe for
+// concurrent use, and a write is never split across two files.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens the file for appending, creating it if need be.
+// A maximum size of 0 means the file is never rotated.
+func NewRotatingFile(path string, maxSize int64, backups int) (*RotatingFile,
+	error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write appends to the file, rotating it first if the write would take
+// it beyond the maximum size.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside, and starts a new one.  It must be
+// called with the lock held.
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+	if rf.backups <= 0 {
+		if err := os.Remove(rf.path); err != nil {
+			return err
+		}
+		return rf.open()
+	}
+	for i := rf.backups - 1; i > 0; i-- {
+		err := os.Rename(rf.backup(i), rf.backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(rf.path, rf.backup(1)); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", rf.path, i)
+}
+
+// Close closes the file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("NewRotatingFile failed: %v", err)
+	}
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n",
+		"eeee\n", "ffffffffffff\n", "gggg\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Writes aren't split, and an oversized one gets a file to itself.
+	for suffix, want := range map[string]string{
+		"":   "gggg\n",
+		".1": "ffffffffffff\n",
+		".2": "eeee\n",
+	} {
+		b, err := os.ReadFile(path + suffix)
+		if err != nil || string(b) != want {
+			t.Fatalf("%s: expected %q, got %q (%v)", suffix, want, b, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups")
+	}
+	if _, err := rf.Write([]byte("x")); err == nil ||
+		!strings.Contains(err.Error(), "closed") {
+		t.Fatalf("expected writes after Close to fail, got %v", err)
+	}
+}
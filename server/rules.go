@@ -0,0 +1,410 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// Defaults for keyed policies that don't say how to evict idle clients.
+const (
+	defaultKeyTTL  = 10 * time.Minute
+	defaultMaxKeys = 10000
+)
+
+// RulesConfig is the declarative form of the limit policies, as read
+// from a JSON rules file.  Each request is matched against the rules in
+// order, and is charged according to the named policy of the first one
+// that matches.  Requests that match no rule fall back to the limiter
+// passed to NewLimiterServer.
+//
+// An example rules file:
+//
+//	{
+//	  "trusted_proxies": ["10.0.0.0/8"],
+//	  "policies": {
+//	    "uploads": {"algorithm": "bucket", "rate": 1048576, "interval": "sec",
+//	                "burst": 5242880, "cost": "bytes", "timeout": "2s"},
+//	    "per-client": {"rate": 60, "interval": "min", "burst": 10,
+//	                   "key": "header:X-API-Key", "timeout": "500ms"}
+//	  },
+//	  "rules": [
+//	    {"method": "POST", "path": "/events/batch", "policy": "uploads"},
+//	    {"path": "/events/**", "policy": "per-client"}
+//	  ]
+//	}
+//
+// The shadow policies are evaluated on every request, but never enforced,
+// to find out who they would turn away before putting them in force.  A
+// shadow policy can't be named by a rule.
+type RulesConfig struct {
+	TrustedProxies []string                `json:"trusted_proxies"`
+	Policies       map[string]PolicyConfig `json:"policies"`
+	Rules          []RuleConfig            `json:"rules"`
+	Shadow         []string                `json:"shadow,omitempty"`
+}
+
+// PolicyConfig describes a limit policy.
+//
+// The algorithm is "pulse" (the default) for a PulseLimiter, or "bucket"
+// for a BucketLimiter.  The rate is the number of tokens per interval,
+// which is one of "msec", "sec" (the default) or "min", and the burst is
+// the capacity of the bucket.
+//
+// The key says how clients are told apart.  It is empty to share one
+// limiter between all of them, "ip" for the client IP, "header:<name>"
+// for the value of a header, "query:<name>" for a query parameter, or
+// "cert:cn" or "cert:san" for the common name or first subject
+// alternative name of a verified client certificate, as per
+// CertSubjectKey and CertSANKey.
+// Idle clients are evicted after the key TTL, and the least recently
+// used ones once there are more than the maximum number of keys.
+//
+// The timeout is how long a request may wait for its tokens, and the
+// cost is "request" (the default) or "bytes", as per CostMode.
+//
+// If the maximum number of waiters is set, requests that can't get their
+// tokens right away queue for them, and are turned away once the queue
+// is full.  The queue discipline is "fifo" (the default), "lifo",
+// "adaptive-lifo" or "codel", with the queue target being the delay used
+// by the latter two, as per limiter.NewQueue.
+type PolicyConfig struct {
+	Algorithm string   `json:"algorithm,omitempty"`
+	Rate      int      `json:"rate"`
+	Interval  string   `json:"interval,omitempty"`
+	Burst     int      `json:"burst"`
+	Key       string   `json:"key,omitempty"`
+	KeyTTL    Duration `json:"key_ttl,omitempty"`
+	MaxKeys   int      `json:"max_keys,omitempty"`
+	Timeout   Duration `json:"timeout,omitempty"`
+	Cost      string   `json:"cost,omitempty"`
+
+	MaxWaiters  int      `json:"max_waiters,omitempty"`
+	Queue       string   `json:"queue,omitempty"`
+	QueueTarget Duration `json:"queue_target,omitempty"`
+}
+
+// RuleConfig matches requests to a policy.  Empty fields match anything.
+// The method is compared without regard to case.  The path and host are
+// patterns as per path.Match, except that a path ending in "/**" matches
+// everything beneath it too, and the host is compared without its port.
+// Each header must be present with the given value, or with any value
+// if that is "*".
+type RuleConfig struct {
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Host    string            `json:"host,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Policy  string            `json:"policy"`
+}
+
+// Duration is a time.Duration that is written as a string such as
+// "500ms" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// A RuleSet is the compiled form of a RulesConfig, with the limiters
+// for each policy ready to go.
+type RuleSet struct {
+	config   RulesConfig
+	policies map[string]*policy
+	rules    []*rule
+	shadows  []*shadow
+}
+
+type rule struct {
+	RuleConfig
+	policy *policy
+}
+
+// LoadRules reads a JSON rules file, and compiles it.
+func LoadRules(file string) (*RuleSet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
+
+// ParseRules reads JSON rules, and compiles them.
+func ParseRules(r io.Reader) (*RuleSet, error) {
+	cfg, err := readRules(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewRuleSet(cfg)
+}
+
+// readRules decodes a JSON rules configuration.  Unknown fields are
+// rejected, so that a misspelt setting isn't silently ignored.
+func readRules(r io.Reader) (RulesConfig, error) {
+	var cfg RulesConfig
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("invalid rules: %v", err)
+	}
+	return cfg, nil
+}
+
+// NewRuleSet validates the rules configuration, and creates the limiters
+// for each of its policies.
+func NewRuleSet(cfg RulesConfig) (*RuleSet, error) {
+	return newRuleSet(cfg, nil)
+}
+
+// newRuleSet compiles the rules configuration.  Any policy of the old
+// rule set whose settings are unchanged is carried over as is, so that
+// its limiters keep their current token counts.
+func newRuleSet(cfg RulesConfig, old *RuleSet) (*RuleSet, error) {
+	trusted, err := ParseCIDRs(cfg.TrustedProxies...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+	sameProxies := old != nil &&
+		strings.Join(old.config.TrustedProxies, ",") ==
+			strings.Join(cfg.TrustedProxies, ",")
+
+	rs := &RuleSet{config: cfg, policies: make(map[string]*policy)}
+	for name, pc := range cfg.Policies {
+		if sameProxies {
+			if opc, ok := old.config.Policies[name]; ok && opc == pc {
+				rs.policies[name] = old.policies[name]
+				continue
+			}
+		}
+		p, err := newPolicy(pc, trusted)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %v", name, err)
+		}
+		p.name = name
+		if old != nil && old.policies[name] != nil {
+			p.keepOverrides(old.policies[name])
+		}
+		rs.policies[name] = p
+	}
+	for i, rc := range cfg.Rules {
+		p, ok := rs.policies[rc.Policy]
+		if !ok {
+			return nil, fmt.Errorf("rule %d: unknown policy %q", i, rc.Policy)
+		}
+		for _, pat := range []string{strings.TrimSuffix(rc.Path, "/**"),
+			rc.Host} {
+			if _, err := path.Match(pat, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: bad pattern %q", i, pat)
+			}
+		}
+		rs.rules = append(rs.rules, &rule{RuleConfig: rc, policy: p})
+	}
+	if rs.shadows, err = newShadows(cfg.Shadow, rs.policies, rs.rules,
+		old); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// match returns the policy of the first rule matching the request, or
+// nil if there is none.
+func (rs *RuleSet) match(r *http.Request) *policy {
+	for _, ru := range rs.rules {
+		if ru.matches(r) {
+			return ru.policy
+		}
+	}
+	return nil
+}
+
+func (ru *rule) matches(r *http.Request) bool {
+	if ru.Method != "" && !strings.EqualFold(ru.Method, r.Method) {
+		return false
+	}
+	if ru.Path != "" {
+		p := ""
+		if r.URL != nil {
+			p = r.URL.Path
+		}
+		if !matchPath(ru.Path, p) {
+			return false
+		}
+	}
+	if ru.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if ok, _ := path.Match(ru.Host, host); !ok {
+			return false
+		}
+	}
+	for name, want := range ru.Headers {
+		vals, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (want != "*" && !contains(vals, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPath matches a path against a pattern, where a trailing "/**"
+// matches the path itself and anything beneath it.
+func matchPath(pattern, p string) bool {
+	if prefix := strings.TrimSuffix(pattern, "/**"); prefix != pattern {
+		// Try the path and each of its parents in turn.
+		for {
+			if ok, _ := path.Match(prefix, p); ok {
+				return true
+			}
+			parent := path.Dir(p)
+			if parent == p {
+				return false
+			}
+			p = parent
+		}
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+func contains(vals []string, want string) bool {
+	for _, v := range vals {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// newPolicy creates the limiters for a policy.
+func newPolicy(pc PolicyConfig, trusted []*net.IPNet) (*policy, error) {
+	interval, err := parseInterval(pc.Interval)
+	if err != nil {
+		return nil, err
+	}
+	var newLimiter func(string) (limiter.Limiter, error)
+	switch pc.Algorithm {
+	case "", "pulse":
+		newLimiter = func(string) (limiter.Limiter, error) {
+			return limiter.NewPulseLimiter(pc.Rate, interval, pc.Burst)
+		}
+	case "bucket":
+		newLimiter = func(string) (limiter.Limiter, error) {
+			return limiter.NewBucketLimiter(pc.Rate, interval, pc.Burst)
+		}
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", pc.Algorithm)
+	}
+	if pc.MaxWaiters > 0 {
+		discipline, err := parseDiscipline(pc.Queue)
+		if err != nil {
+			return nil, err
+		}
+		newBase := newLimiter
+		newLimiter = func(key string) (limiter.Limiter, error) {
+			l, err := newBase(key)
+			if err != nil {
+				return nil, err
+			}
+			return limiter.NewQueue(l, pc.MaxWaiters, discipline,
+				time.Duration(pc.QueueTarget)), nil
+		}
+	}
+
+	p := &policy{config: &pc, timeout: time.Duration(pc.Timeout)}
+	switch pc.Cost {
+	case "", "request":
+		p.cost = CostRequest
+	case "bytes":
+		p.cost = CostBytes
+	default:
+		return nil, fmt.Errorf("unknown cost %q", pc.Cost)
+	}
+
+	switch {
+	case pc.Key == "":
+	case pc.Key == "ip":
+		p.key = RemoteIPKey(trusted...)
+	case strings.HasPrefix(pc.Key, "header:"):
+		p.key = HeaderKey(strings.TrimPrefix(pc.Key, "header:"))
+	case strings.HasPrefix(pc.Key, "query:"):
+		p.key = QueryKey(strings.TrimPrefix(pc.Key, "query:"))
+	case pc.Key == "cert:cn":
+		p.key = CertSubjectKey()
+	case pc.Key == "cert:san":
+		p.key = CertSANKey()
+	default:
+		return nil, fmt.Errorf("unknown key %q", pc.Key)
+	}
+
+	// Create one limiter up front, even for keyed policies, so that the
+	// settings are validated.
+	l, err := newLimiter("")
+	if err != nil {
+		return nil, err
+	}
+	if p.key == nil {
+		p.limiter = l
+		return p, nil
+	}
+	ttl, maxKeys := time.Duration(pc.KeyTTL), pc.MaxKeys
+	if ttl == 0 {
+		ttl = defaultKeyTTL
+	}
+	if maxKeys == 0 {
+		maxKeys = defaultMaxKeys
+	}
+	p.keyed = limiter.NewRegistry(newLimiter, ttl, maxKeys)
+	return p, nil
+}
+
+func parseInterval(s string) (limiter.IntervalType, error) {
+	switch s {
+	case "msec":
+		return limiter.Msec, nil
+	case "", "sec":
+		return limiter.Sec, nil
+	case "min":
+		return limiter.Min, nil
+	}
+	return 0, fmt.Errorf("unknown interval %q", s)
+}
+
+func parseDiscipline(s string) (limiter.Discipline, error) {
+	switch s {
+	case "", "fifo":
+		return limiter.FIFO, nil
+	case "lifo":
+		return limiter.LIFO, nil
+	case "adaptive-lifo":
+		return limiter.AdaptiveLIFO, nil
+	case "codel":
+		return limiter.CoDel, nil
+	}
+	return 0, fmt.Errorf("unknown queue %q", s)
+}
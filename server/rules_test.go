@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRules = `{
+  "policies": {
+    "strict": {"algorithm": "bucket", "rate": 1, "interval": "min",
+               "burst": 1, "timeout": "10ms"},
+    "per-client": {"algorithm": "bucket", "rate": 1, "interval": "min",
+                   "burst": 2, "key": "header:X-API-Key", "timeout": "10ms"}
+  },
+  "rules": [
+    {"method": "delete", "path": "/events/*", "policy": "strict"},
+    {"path": "/events/**", "headers": {"X-API-Key": "*"},
+     "policy": "per-client"}
+  ]
+}`
+
+func TestRules(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatalf("Parsing rules failed: %v", err)
+	}
+	server := NewLimiterServer(8080, nil, time.Second, "http://dummy",
+		WithRules(rs))
+	var x int64
+	ph := placeHolder{&x}
+	h := server.enforceLimits(http.HandlerFunc(ph.eventHandler))
+
+	for i, tc := range []struct {
+		method string
+		path   string
+		key    string
+		admit  bool
+	}{
+		{method: "DELETE", path: "/events/1", admit: true},
+		{method: "DELETE", path: "/events/2", admit: false},
+		{method: "POST", path: "/events", key: "a", admit: true},
+		{method: "POST", path: "/events/1/x", key: "a", admit: true},
+		{method: "POST", path: "/events", key: "a", admit: false},
+		{method: "POST", path: "/events", key: "b", admit: true},
+		// Matches no rule, and there's no default limiter.
+		{method: "POST", path: "/events", admit: true},
+		{method: "POST", path: "/events", admit: true},
+	} {
+		before := x
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.key != "" {
+			r.Header.Set("X-API-Key", tc.key)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if admitted := x > before; admitted != tc.admit {
+			t.Fatalf("%d: expected admitted to be %t", i, tc.admit)
+		}
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rules := range []string{
+		`{"policies": {"p": {"rate": 1, "burst": 1}}, "rules": [{"policy": "q"}]}`,
+		`{"policies": {"p": {"rate": 0, "burst": 1}}}`,
+		`{"policies": {"p": {"rate": 1, "burst": 1, "algorithm": "magic"}}}`,
+		`{"policies": {"p": {"rate": 1, "burst": 1, "timeout": 5}}}`,
+		`{"policies": {"p": {"rate": 1, "burst": 1, "key": "cookie"}}}`,
+		`{"policies": {"p": {"rate": 1, "burst": 1, "max_waiters": 5, "queue": "random"}}}`,
+		`{"policies": {}, "rule": []}`,
+		`{"policies": {"p": {"rate": 1, "burst": 1}}, "shadow": ["q"]}`,
+		`{"policies": {"p": {"rate": 1, "burst": 1}}, "rules": [{"policy": "p"}], "shadow": ["p"]}`,
+	} {
+		if _, err := ParseRules(strings.NewReader(rules)); err == nil {
+			t.Fatalf("expected rules to be rejected: %s", rules)
+		}
+	}
+}
@@ -16,13 +16,18 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
+	"net/http/httputil"
 	"strconv"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/gdotgordon/rate_limiter/limiter"
@@ -30,117 +35,611 @@ import (
 
 const connTimeout = 30
 
+// defaultPolicy is the name of the policy made up of the limiter passed
+// to NewLimiterServer.
+const defaultPolicy = "default"
+
+// allowPolicy is the name of the policy of the allow list.
+const allowPolicy = "allowlist"
+
+// Default timeouts for client connections, so that slow or idle clients
+// can't hold connections open indefinitely.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// defaultDrainTimeout is how long requests in progress are given to
+// finish on shutdown.
+const defaultDrainTimeout = 30 * time.Second
+
+// defaultAdminHost keeps the admin API off the network unless it's asked
+// to listen elsewhere.
+const defaultAdminHost = "127.0.0.1"
+
 // The LimiterServer is the type implementing the rate limiting service.
 // As explained above, it could easily be extended to cover other functions
 // besides rate limiting with regard to the service it proxies.
 type LimiterServer struct {
 	port           int
-	timeout        time.Duration
 	proxiedURL     string
-	proxiedService *http.Client
-	limiter        limiter.Limiter
+	proxiedService *httputil.ReverseProxy
+	handler        http.Handler
+	routes         []string
+	policy         *policy
+	rules          atomic.Value // *RuleSet
+	rulesFile      string
+	rulesPoll      time.Duration
+	reloadMu       sync.Mutex
+	upload         limiter.Limiter
+	download       limiter.Limiter
+
+	acceptLimiter     limiter.Limiter
+	maxConnsPerIP     int
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	tlsConfig         *tls.Config
+	certs             *certStore
+
+	rejectStatus  int
+	maxClientWait time.Duration
+	breaker       *breaker
+	admitted      atomic.Uint64
+	rejected      atomic.Uint64
+	canceled      atomic.Uint64
+	queue         func(limiter.Limiter) limiter.Limiter
+
+	pool          *pool
+	maxFails      int
+	ejectFor      time.Duration
+	probePath     string
+	probeInterval time.Duration
+	shutdownDelay time.Duration
+	drainTimeout  time.Duration
+	draining      atomic.Bool
+
+	adminPort int
+	adminHost string
+	adminAuth AdminAuthorizer
+	auditMu   sync.Mutex
+	auditLog  io.Writer
+	accessMu  sync.Mutex
+	accessLog io.Writer
+
+	shadowPolicies []*shadow
+	shadowErr      error
+
+	trustedProxies []*net.IPNet
+	clientKey      KeyFunc
+	denyList       *IPSet
+	allowList      *IPSet
+	allowPolicy    *policy
+
+	concurrency  *limiter.AdaptiveLimiter
+	backpressure *backpressure
+	idempotency  *idempotencyCache
+
+	// Set while the server is running, so that policies added by a
+	// reload can be served.
+	servingMu sync.Mutex
+	runCtx    context.Context
+	runWg     *sync.WaitGroup
+	serving   map[*policy]context.CancelFunc
 }
 
 // NewLimiterServer creates a server that runs on the specified port,
 // and applies the provided Limiter to filter incoming requests.  The
 // timeout refers to the client timeout in trying to get through the
 // rate limiter.  The proxied URL is the URL of the backend storage
-// service that requests are forwarded to.
+// service that requests are forwarded to, which by default are those
+// under "/events", unless WithBackends gives several replicas of it.
+// Any options are applied in order.
 func NewLimiterServer(port int, limiter limiter.Limiter,
-	timeout time.Duration, proxiedURL string) *LimiterServer {
-	ls := &LimiterServer{port: port, timeout: timeout, proxiedURL: proxiedURL}
-	ls.limiter = limiter
-	ls.proxiedService = &http.Client{
-		Timeout: time.Duration(connTimeout) * time.Second,
+	timeout time.Duration, proxiedURL string, opts ...Option) *LimiterServer {
+	ls := &LimiterServer{port: port, proxiedURL: proxiedURL}
+	ls.policy = &policy{name: defaultPolicy, limiter: limiter,
+		timeout: timeout}
+	ls.readHeaderTimeout = defaultReadHeaderTimeout
+	ls.idleTimeout = defaultIdleTimeout
+	ls.routes = []string{defaultRoute}
+	ls.rulesPoll = defaultRulesPoll
+	ls.rejectStatus = http.StatusServiceUnavailable
+	ls.probeInterval = defaultProbeInterval
+	ls.drainTimeout = defaultDrainTimeout
+	ls.adminHost = defaultAdminHost
+	for _, opt := range opts {
+		opt(ls)
+	}
+	if ls.pool == nil {
+		ls.pool = newPool(RoundRobin, Backend{URL: proxiedURL})
+	}
+	if ls.maxFails > 0 {
+		ls.pool.maxFails = ls.maxFails
+	}
+	if ls.ejectFor > 0 {
+		ls.pool.ejectFor = ls.ejectFor
 	}
+	ls.clientKey = RemoteIPKey(ls.trustedProxies...)
+	if ls.queue != nil && ls.policy.limiter != nil {
+		ls.policy.limiter = ls.queue(ls.policy.limiter)
+	}
+	ls.proxiedService = ls.newReverseProxy()
+	ls.handler = ls.newHandler()
 	return ls
 }
 
-// Start starts the token generator loop.  It is blocking, so
-// it should be started in a goroutine.
+// Start listens on the server's port, and serves requests until the
+// context is canceled, as per Serve.  It is blocking, so it should be
+// started in a goroutine.
 func (ls *LimiterServer) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(ls.port))
+	if err != nil {
+		return err
+	}
+	return ls.Serve(ctx, ln)
+}
+
+// Serve serves requests arriving on the listener, which it takes over,
+// along with the admin API if it has a port.  It runs everything the
+// server needs in the background, as per Run, and returns once the
+// context is canceled and the server has shut down.
+//
+// On shutdown, the server reports itself not ready, waits out the
+// shutdown delay, and then stops accepting connections.  Requests in
+// progress are given until the drain timeout to finish, after which
+// their connections are closed.
+func (ls *LimiterServer) Serve(ctx context.Context, ln net.Listener) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Start producing tokens for the bucket.
-	var err error
+	// Background work keeps running until the requests have drained.
+	runCtx, stopRun := context.WithCancel(context.Background())
+	defer stopRun()
+	wait, err := ls.run(runCtx)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	defer func() {
+		stopRun()
+		wait()
+	}()
+	ln = NewProtectedListener(ln, ls.acceptLimiter, ls.maxConnsPerIP)
+
+	// The admin API has a listener of its own, apart from the public one.
+	var admin *http.Server
+	if ls.adminPort > 0 {
+		aln, err := net.Listen("tcp", net.JoinHostPort(ls.adminHost,
+			strconv.Itoa(ls.adminPort)))
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		admin = &http.Server{Handler: ls.AdminHandler(),
+			ReadHeaderTimeout: ls.readHeaderTimeout}
+		go func() {
+			log.Printf("Admin API accepting requests on %s ...\n",
+				aln.Addr())
+			if err := admin.Serve(aln); err != http.ErrServerClosed {
+				log.Printf("Admin API: %v\n", err)
+			}
+		}()
+	}
+
+	s := &http.Server{
+		Handler:           ls.Handler(),
+		ReadHeaderTimeout: ls.readHeaderTimeout,
+		IdleTimeout:       ls.idleTimeout,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+
+		// Report not ready, and give the load balancers a chance to
+		// notice before shutting down.
+		ls.draining.Store(true)
+		if ls.shutdownDelay > 0 {
+			time.Sleep(ls.shutdownDelay)
+		}
+
+		sctx, scancel := context.WithTimeout(context.Background(),
+			ls.drainTimeout)
+		defer scancel()
+		if admin != nil {
+			admin.Shutdown(sctx)
+		}
+		if err := s.Shutdown(sctx); err != nil {
+			log.Printf("HTTP server Shutdown: %v", err)
+			s.Close()
+		}
+	}()
+
+	if ls.tlsConfig != nil {
+		// The certificates come from the configuration, not from files.
+		s.TLSConfig = ls.tlsConfig
+		log.Printf("Limiter server accepting TLS requests on %s ...\n",
+			ln.Addr())
+		err = s.ServeTLS(ln, "", "")
+	} else {
+		log.Printf("Limiter server accepting requests on %s ...\n",
+			ln.Addr())
+		err = s.Serve(ln)
+	}
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	cancel()
+	<-done
+	return err
+}
+
+// Handler returns the handler that applies the limits and forwards the
+// admitted requests to the proxied service, and that answers the health
+// and readiness probes.  It may be mounted in a larger service, in which
+// case Run must be running alongside it.
+func (ls *LimiterServer) Handler() http.Handler {
+	return ls.handler
+}
+
+// AdminHandler returns the handler for the admin API, for services that
+// mount it themselves rather than giving it a port.
+func (ls *LimiterServer) AdminHandler() http.Handler {
+	return ls.adminHandler()
+}
+
+// newHandler builds the handler returned by Handler.
+func (ls *LimiterServer) newHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Encapsulate the proxy inside limit checker.
+	h := ls.logAccess(ls.filterIPs(ls.idempotent(ls.enforceLimits(
+		http.HandlerFunc(ls.proxyHandler)))))
+	for _, route := range ls.routes {
+		mux.Handle(route, h)
+		if !strings.HasSuffix(route, "/") {
+			// Also cover the resources beneath the route.
+			mux.Handle(route+"/", h)
+		}
+	}
+
+	mux.HandleFunc(healthPath, ls.healthz)
+	mux.HandleFunc(readyPath, ls.readyz)
+	return mux
+}
+
+// Run runs what the server needs in the background: the token servers of
+// its limiters, the reloading of its rules, and the probing of its
+// backends.  The rules file, if any, is read first, and an error is
+// returned if that fails.  It is a blocking call that returns once the
+// context is canceled.  Serve calls it, so it is only needed when the
+// handler is mounted in a larger service.
+func (ls *LimiterServer) Run(ctx context.Context) error {
+	wait, err := ls.run(ctx)
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	wait()
+	return nil
+}
+
+// run starts the background work, and returns a function that waits
+// for it to finish once the context is canceled.
+func (ls *LimiterServer) run(ctx context.Context) (func(), error) {
+	if ls.shadowErr != nil {
+		return nil, ls.shadowErr
+	}
+	if ls.rulesFile != "" {
+		if err := ls.Reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	if ls.certs != nil {
+		if _, err := ls.certs.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Start producing tokens for the buckets.
 	var wg sync.WaitGroup
-	if ls.limiter.HasTokenServer() {
+	for _, l := range ls.tokenServers() {
+		wg.Add(1)
+		go func(l limiter.Limiter) {
+			defer wg.Done()
+
+			l.ServeTokens(ctx)
+		}(l)
+	}
+
+	// Policies serve their own limiters, including keyed ones that are
+	// created later on, and those brought in by a reload.
+	ls.servingMu.Lock()
+	ls.runCtx, ls.runWg = ctx, &wg
+	ls.serving = make(map[*policy]context.CancelFunc)
+	ls.servingMu.Unlock()
+	ls.servePolicies()
+	if ls.certs != nil {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
-			ls.limiter.ServeTokens(ctx)
+			ls.certs.watch(ctx)
 		}()
 	}
+	if ls.rulesFile != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-	// Setup the clean shutdown.
-	wg.Add(1)
-	s := http.Server{
-		Addr: ":" + strconv.Itoa(ls.port),
+			ls.watchRules(ctx)
+		}()
 	}
-	go func() {
-		defer wg.Done()
+	if ls.probePath != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM)
-		<-sigint
+			ls.probeBackends(ctx)
+		}()
+	}
+	return wg.Wait, nil
+}
 
-		// We received an interrupt signal, shut down.
-		if err := s.Shutdown(ctx); err != nil {
-			// Error from closing listeners, or context timeout:
-			log.Printf("HTTP server Shutdown: %v", err)
+// tokenServers returns the limiters whose token server loops need to
+// run while the server is up, other than those of the policies, which
+// serve their own.  A limiter used in more than one role is only served
+// once.
+func (ls *LimiterServer) tokenServers() []limiter.Limiter {
+	var res []limiter.Limiter
+	seen := map[limiter.Limiter]bool{ls.policy.limiter: true}
+	lims := []limiter.Limiter{ls.upload, ls.download, ls.acceptLimiter}
+	for _, b := range ls.pool.backends {
+		lims = append(lims, b.Limiter)
+	}
+	for _, l := range lims {
+		if l == nil || seen[l] || !l.HasTokenServer() {
+			continue
 		}
+		seen[l] = true
+		res = append(res, l)
+	}
+	return res
+}
 
-		// Invoking the cancel function should cleanup the limiter.
-		cancel()
-	}()
-
-	// Encapsulate event storer inside limit checker.
-	http.Handle("/events", ls.enforceLimits(ctx,
-		http.HandlerFunc(ls.eventHandler)))
+// policies returns all of the limit policies in use.
+func (ls *LimiterServer) policies() []*policy {
+	res := []*policy{ls.policy}
+	if ls.allowPolicy != nil {
+		res = append(res, ls.allowPolicy)
+	}
+	for _, s := range ls.shadowPolicies {
+		res = append(res, s.policy)
+	}
+	if rs := ls.currentRules(); rs != nil {
+		for _, p := range rs.policies {
+			res = append(res, p)
+		}
+	}
+	return res
+}
 
-	log.Printf("Limiter server accepting requests on port %d ...\n", ls.port)
-	log.Println(s.ListenAndServe())
-	wg.Wait()
-	return err
+// policyFor returns the policy that applies to the request, which is
+// that of the allow list, if the client is on it, or else that of the
+// first matching rule, if any.
+func (ls *LimiterServer) policyFor(r *http.Request) *policy {
+	if ls.allowPolicy != nil && ls.allowList.Contains(ls.clientIP(r)) {
+		return ls.allowPolicy
+	}
+	if rs := ls.currentRules(); rs != nil {
+		if p := rs.match(r); p != nil {
+			return p
+		}
+	}
+	return ls.policy
 }
 
 // enforceLimits is a "middleware" pattern that allows us to
 // inject additional functionality (here, enforcing rate limiting)
-// to the base functionality (posting an event).
-func (ls *LimiterServer) enforceLimits(ctx context.Context,
-	next http.Handler) http.Handler {
+// to the base functionality (posting an event).  Waiting for tokens
+// is bound to the request's context, so that a client that gives up
+// and disconnects stops waiting, rather than having tokens consumed
+// for a request nobody will see.
+func (ls *LimiterServer) enforceLimits(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		res, err := ls.limiter.AcquireToken(ctx, ls.timeout)
+		ctx := r.Context()
+		p := ls.policyFor(r)
+		key := p.keyOf(r)
+		e := entryOf(ctx)
+		if e != nil {
+			e.Policy, e.Key = p.name, key
+		}
+		ls.evaluateShadows(r, e)
+		lim, err := p.limiterFor(key)
 		if err != nil {
+			e.decide(DecisionError, nil)
 			http.Error(w, "Token error", http.StatusInternalServerError)
 			return
 		}
-		if !res {
-			// Could not acquire token in time.
-			http.Error(w, "System too busy", http.StatusServiceUnavailable)
+		if lim == nil {
+			e.decide(DecisionUnlimited, nil)
+			ls.forward(w, r, nil, 0, next)
 			return
 		}
-		next.ServeHTTP(w, r)
+		// The headers are brought up to date once the request is charged.
+		setRateLimitHeaders(w.Header(), lim)
+		cost, ok := p.requestCost(ctx, w, r, lim)
+		if !ok {
+			e.decide(DecisionTooLarge, lim)
+			return
+		}
+
+		// A cost of 0 means the body is charged as it streams through.
+		if cost > 0 {
+			var res bool
+			start := time.Now()
+			if timeout, now := ls.waitFor(w, r, p); now {
+				res, err = acquireNow(ctx, lim, cost)
+			} else {
+				res, err = limiter.AcquireTokens(ctx, lim, cost, timeout)
+			}
+			if e != nil {
+				e.Cost, e.Wait = cost, millis(time.Since(start))
+			}
+			if err != nil && ctx.Err() != nil {
+				// The client gave up waiting, so there's nobody to
+				// answer.
+				ls.canceled.Add(1)
+				e.decide(DecisionCanceled, lim)
+				return
+			}
+			if err != nil && !errors.Is(err, limiter.ErrClosed) {
+				e.decide(DecisionError, lim)
+				http.Error(w, "Token error", http.StatusInternalServerError)
+				return
+			}
+			if !res {
+				// Could not acquire token in time, or the limiter was
+				// evicted or replaced while the request waited.
+				e.decide(DecisionRejected, lim)
+				ls.reject(w, lim, cost)
+				return
+			}
+		}
+		e.decide(DecisionAdmitted, lim)
+		setRateLimitHeaders(w.Header(), lim)
+		ls.forward(w, r, lim, cost, next)
 	})
 }
 
-// eventHandler will be invoked to store the event if
-func (ls *LimiterServer) eventHandler(w http.ResponseWriter,
-	r *http.Request) {
-	if r.Body == nil {
-		http.Error(w, "Empty body", http.StatusBadRequest)
-		return
+// Stats counts what became of the requests the server has seen.  Those
+// that were admitted were forwarded to the proxied service, while those
+// that got their tokens but then failed fast, because of backpressure,
+// the circuit breaker or the concurrency limit, are not counted.  Those
+// that were rejected ran out of time waiting for tokens, or found the
+// wait queue full, or, if charged by the byte, had their body run out of
+// tokens after being forwarded, while those that were canceled were
+// given up on by their clients while still waiting.
+type Stats struct {
+	Admitted uint64        `json:"admitted"`
+	Rejected uint64        `json:"rejected"`
+	Canceled uint64        `json:"canceled"`
+	Shadow   []ShadowStats `json:"shadow,omitempty"`
+
+	// Concurrency is the state of the adaptive concurrency limit, if any.
+	Concurrency *ConcurrencyStats `json:"concurrency,omitempty"`
+
+	// Backpressure is the state of the backpressure, if any.
+	Backpressure *BackpressureStats `json:"backpressure,omitempty"`
+
+	// Breaker is the state of the circuit breaker, if any.
+	Breaker *BreakerStats `json:"breaker,omitempty"`
+
+	// Idempotency is the state of the idempotency cache, if any.
+	Idempotency *IdempotencyStats `json:"idempotency,omitempty"`
+}
+
+// ConcurrencyStats gives the adaptive concurrency limit, as computed from
+// the latency of the backends, and the number of requests in flight.
+type ConcurrencyStats struct {
+	Limit    int `json:"limit"`
+	Inflight int `json:"inflight"`
+}
+
+// Stats returns the counts of requests admitted, rejected and canceled
+// since the server was created, the would-be decisions of any shadow
+// policies, the adaptive concurrency limit, the backpressure, and the
+// idempotency cache.
+func (ls *LimiterServer) Stats() Stats {
+	st := Stats{Admitted: ls.admitted.Load(), Rejected: ls.rejected.Load(),
+		Canceled: ls.canceled.Load(), Shadow: ls.shadowStats()}
+	if ls.concurrency != nil {
+		st.Concurrency = &ConcurrencyStats{Limit: ls.concurrency.Limit(),
+			Inflight: ls.concurrency.Inflight()}
+	}
+	if ls.backpressure != nil {
+		bs := ls.backpressure.stats(time.Now())
+		st.Backpressure = &bs
 	}
+	if ls.breaker != nil {
+		bs := ls.breaker.stats()
+		st.Breaker = &bs
+	}
+	if ls.idempotency != nil {
+		is := ls.idempotency.stats()
+		st.Idempotency = &is
+	}
+	return st
+}
 
-	// Invoke the proxied service and capture the result.
-	resp, err := ls.proxiedService.Post(ls.proxiedURL+"/events",
-		"application/json", r.Body)
+// forward passes an admitted request on to a backend, unless the proxied
+// service has asked for less load, the circuit breaker is open, the
+// adaptive concurrency limit has been reached, or every backend is at
+// its limit, in which case the request fails fast and the tokens it was
+// charged are refunded.  Only requests passed on count as admitted.
+func (ls *LimiterServer) forward(w http.ResponseWriter, r *http.Request,
+	lim limiter.Limiter, cost int, next http.Handler) {
+	ctx := r.Context()
+	shed := func(decision, detail string, wait time.Duration) {
+		if e := entryOf(ctx); e != nil {
+			e.Decision = decision
+		}
+		if lim != nil && cost > 0 {
+			limiter.Refund(lim, cost)
+		}
+		setRateLimitHeaders(w.Header(), lim)
+		retry := int(math.Ceil(wait.Seconds()))
+		if retry < 1 {
+			retry = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		writeProblem(w, http.StatusServiceUnavailable, detail, retry)
+	}
+
+	if ls.backpressure != nil {
+		if ok, wait := ls.backpressure.admit(time.Now()); !ok {
+			shed(DecisionBackpressure, "Service overloaded", wait)
+			return
+		}
+	}
+	if ls.breaker != nil {
+		t, wait := ls.breaker.allow()
+		if t == nil {
+			shed(DecisionBreakerOpen, errBreakerOpen.Error(), wait)
+			return
+		}
+		defer t.release()
+		ctx = context.WithValue(ctx, ticketKey{}, t)
+	}
+	if ls.concurrency != nil {
+		release, ok := ls.concurrency.Acquire()
+		if !ok {
+			shed(DecisionShed, "Concurrency limit reached", 0)
+			return
+		}
+		rs := &rttSample{}
+		defer func() { release(rs.rtt, rs.dropped) }()
+		ctx = context.WithValue(ctx, rttKey{}, rs)
+	}
+	b, err := ls.pool.pick(ls.probePath != "")
 	if err != nil {
-		http.Error(w, "Service error", http.StatusInternalServerError)
+		// Every backend is at its limit.
+		if e := entryOf(ctx); e != nil {
+			e.Decision = DecisionBusy
+		}
+		if lim != nil && cost > 0 {
+			limiter.Refund(lim, cost)
+		}
+		ls.turnAway(w, lim, ls.pool.retryAfter())
 		return
 	}
-	w.WriteHeader(resp.StatusCode)
-	return
+	defer b.done()
+	ctx = context.WithValue(ctx, backendKey{}, b)
+	if lim != nil {
+		ctx = context.WithValue(ctx, limiterKey{}, lim)
+	}
+	r = r.WithContext(ctx)
+	ls.admitted.Add(1)
+	next.ServeHTTP(w, r)
 }
@@ -2,7 +2,13 @@ package server
 
 import (
 	"context"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -56,7 +62,7 @@ func TestEnforceLimits(t *testing.T) {
 			defer wg2.Done()
 
 			ha := &http.Request{}
-			server.enforceLimits(context.Background(),
+			server.enforceLimits(
 				http.HandlerFunc(ph.eventHandler)).ServeHTTP(ph, ha)
 		}()
 	}
@@ -67,3 +73,278 @@ func TestEnforceLimits(t *testing.T) {
 		t.Fatalf("Expected count = 3, got %d", *ph.v)
 	}
 }
+
+func TestByteCost(t *testing.T) {
+	var stored int64
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+				return
+			}
+			atomic.AddInt64(&stored, 1)
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer ts.Close()
+
+	b, err := limiter.NewBucketLimiter(100, limiter.Min, 100)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, 100*time.Millisecond, ts.URL,
+		WithCostMode(CostBytes))
+	h := server.enforceLimits(http.HandlerFunc(server.proxyHandler))
+
+	for i, tc := range []struct {
+		size    int
+		chunked bool
+		status  int
+	}{
+		{size: 60, status: http.StatusCreated},
+		{size: 60, status: http.StatusServiceUnavailable},
+		{size: 150, status: http.StatusRequestEntityTooLarge},
+		{size: 150, chunked: true, status: http.StatusRequestEntityTooLarge},
+		{size: 30, chunked: true, status: http.StatusCreated},
+		{size: 60, chunked: true, status: http.StatusServiceUnavailable},
+	} {
+		r := httptest.NewRequest("POST", "/events",
+			strings.NewReader(strings.Repeat("x", tc.size)))
+		if tc.chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Fatalf("%d: expected status %d, got %d", i, tc.status, w.Code)
+		}
+		if tc.status == http.StatusServiceUnavailable &&
+			w.Header().Get("Retry-After") == "" {
+			t.Fatalf("%d: expected a Retry-After header", i)
+		}
+	}
+	if stored != 2 {
+		t.Fatalf("Expected 2 stored events, got %d", stored)
+	}
+	if st := server.Stats(); st.Rejected != 2 {
+		t.Fatalf("Expected 2 rejections, got %+v", st)
+	}
+}
+
+// Test that each client gets a bucket of its own.
+func TestKeyedLimits(t *testing.T) {
+	reg := limiter.NewRegistry(func(string) (limiter.Limiter, error) {
+		return limiter.NewBucketLimiter(1, limiter.Min, 2)
+	}, time.Minute, 0)
+	server := NewLimiterServer(8080, nil, 10*time.Millisecond, "http://dummy",
+		WithKeyedLimits(reg, HeaderKey("X-API-Key")))
+	var x int64
+	ph := placeHolder{&x}
+	h := server.enforceLimits(http.HandlerFunc(ph.eventHandler))
+
+	for _, key := range []string{"a", "a", "a", "b", "b", "b", ""} {
+		r := httptest.NewRequest("POST", "/events", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if x != 5 || reg.Len() != 3 {
+		t.Fatalf("Expected count = 5 with 3 keys, got %d with %d", x, reg.Len())
+	}
+}
+
+// Test that requests beyond the bounded wait queue are turned away
+// immediately, rather than waiting out their timeout, and that clients
+// that give up stop waiting.
+func TestWaitQueue(t *testing.T) {
+	b, err := limiter.NewBucketLimiter(1, limiter.Min, 1)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, 5*time.Second, "http://dummy",
+		WithWaitQueue(1, limiter.FIFO, 0))
+	h := server.enforceLimits(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(ctx context.Context) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil).
+			WithContext(ctx))
+		return w.Code
+	}
+
+	if code := send(context.Background()); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+
+	// With the dispatcher not running, the next request fills the queue.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		send(ctx)
+	}()
+	q := server.policy.limiter.(*limiter.QueuedLimiter)
+	for q.Waiting() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if code := send(context.Background()); code !=
+		http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("rejection took %v", d)
+	}
+
+	// The client disconnecting frees its place in the queue.
+	cancel()
+	wg.Wait()
+	if n := q.Waiting(); n != 0 {
+		t.Fatalf("expected an empty queue, got %d", n)
+	}
+	if st := server.Stats(); st.Admitted != 1 || st.Rejected != 1 ||
+		st.Canceled != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+// Test that servers can be embedded side by side on injected listeners,
+// and shut down by their contexts.
+func TestServe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("stored"))
+		}))
+	t.Cleanup(backend.Close)
+
+	for i := 0; i < 2; i++ {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+			b, err := limiter.NewPulseLimiter(100, limiter.Sec, 1)
+			if err != nil {
+				t.Fatalf("Pulse creation failed: %v\n", err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+			server := NewLimiterServer(0, b, time.Second, backend.URL,
+				WithDrainTimeout(time.Second))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errc := make(chan error, 1)
+			go func() {
+				errc <- server.Serve(ctx, ln)
+			}()
+
+			base := "http://" + ln.Addr().String()
+			resp, err := http.Post(base+"/events", "application/json",
+				strings.NewReader("{}"))
+			if err != nil {
+				t.Fatalf("Post failed: %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "stored" {
+				t.Fatalf("unexpected response %d: %s", resp.StatusCode, body)
+			}
+			resp, err = http.Get(base + readyPath)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected the server to be ready, got %d",
+					resp.StatusCode)
+			}
+
+			cancel()
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Fatalf("Serve failed: %v", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Serve did not return")
+			}
+		})
+	}
+}
+
+// Test that clients can ask to wait less, or longer, than the policy's
+// timeout, up to the server's ceiling.
+func TestClientWait(t *testing.T) {
+	b, err := limiter.NewBucketLimiter(10, limiter.Sec, 1)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	server := NewLimiterServer(8080, b, 20*time.Millisecond, "http://dummy",
+		WithMaxClientWait(time.Second))
+	h := server.enforceLimits(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, tc := range []struct {
+		header, value string
+		status        int
+		applied       string
+	}{
+		{status: http.StatusOK},
+		// The policy's timeout is too short for the next token.
+		{status: http.StatusServiceUnavailable},
+		{header: maxWaitHeader, value: "0", status: http.StatusServiceUnavailable},
+		{header: maxWaitHeader, value: "300ms", status: http.StatusOK},
+		{header: preferHeader, value: "respond-async, wait=1", status: http.StatusOK,
+			applied: "wait=1"},
+		// The ceiling applies.
+		{header: preferHeader, value: "wait=60", status: http.StatusOK,
+			applied: "wait=1"},
+		{header: maxWaitHeader, value: "bogus", status: http.StatusServiceUnavailable},
+	} {
+		r := httptest.NewRequest("POST", "/events", nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Fatalf("%d: expected status %d, got %d", i, tc.status, w.Code)
+		}
+		if got := w.Header().Get("Preference-Applied"); got != tc.applied {
+			t.Fatalf("%d: expected Preference-Applied %q, got %q", i,
+				tc.applied, got)
+		}
+	}
+}
+
+func TestParseClientWait(t *testing.T) {
+	for _, tc := range []struct {
+		header, value string
+		wait          time.Duration
+		ok            bool
+	}{
+		{maxWaitHeader, "2.5", 2500 * time.Millisecond, true},
+		{maxWaitHeader, "150ms", 150 * time.Millisecond, true},
+		{maxWaitHeader, "-1", 0, false},
+		{preferHeader, `wait="3"`, 3 * time.Second, true},
+		{preferHeader, "return=minimal", 0, false},
+		{preferHeader, "wait=soon", 0, false},
+		// Values too large for a duration are capped, not overflowed.
+		{maxWaitHeader, "Inf", 0, false},
+		{maxWaitHeader, "-Inf", 0, false},
+		{maxWaitHeader, "NaN", 0, false},
+		{maxWaitHeader, "1e300", time.Minute, true},
+		{maxWaitHeader, "99999999999", time.Minute, true},
+		{maxWaitHeader, "2h", time.Minute, true},
+		{preferHeader, "wait=99999999999", time.Minute, true},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(tc.header, tc.value)
+		if d, _, ok := clientWait(r, time.Minute); d != tc.wait ||
+			ok != tc.ok {
+			t.Fatalf("%s: %s: expected %v %t, got %v %t", tc.header, tc.value,
+				tc.wait, tc.ok, d, ok)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// A shadow policy is a candidate policy that is evaluated on every
+// request, with limiters of its own, but whose decisions are only
+// recorded, never enforced.  It shows which clients a tighter limit, or
+// another algorithm, would turn away, before it is put in force.  Its
+// would-be rejections are counted in Stats, and recorded in the access
+// log along with the client's key.
+//
+// A request that can't get its shadow tokens right away waits for them
+// in the background, for up to the policy's timeout, so that the
+// decision is the one the policy would make, without holding up the
+// request.  As under overload that would build up a goroutine per
+// request, only so many may wait at a time, and a request that finds no
+// room counts as rejected, as it would be by a bounded wait queue.
+// Requests whose body is charged as it streams through are
+// charged their declared length, or one token if it isn't known.
+
+// maxShadowKeys bounds the number of clients whose would-be rejections
+// are counted apiece.  Beyond that, new clients are only counted in the
+// total.
+const maxShadowKeys = 1000
+
+// maxShadowWaiters bounds the number of requests waiting for the tokens
+// of a shadow policy.
+const maxShadowWaiters = 100
+
+type shadow struct {
+	policy  *policy
+	waiters chan struct{} // a semaphore for the requests waiting
+
+	mu       sync.Mutex
+	admitted uint64
+	rejected uint64
+	keys     map[string]uint64
+}
+
+func newShadow(p *policy) *shadow {
+	return &shadow{policy: p, waiters: make(chan struct{}, maxShadowWaiters),
+		keys: make(map[string]uint64)}
+}
+
+// ShadowStats counts the decisions of a shadow policy, and which clients
+// it would have turned away, and how often.
+type ShadowStats struct {
+	Policy       string            `json:"policy"`
+	Admitted     uint64            `json:"admitted"`
+	Rejected     uint64            `json:"rejected"`
+	RejectedKeys map[string]uint64 `json:"rejected_keys,omitempty"`
+}
+
+// ShadowDecision is what a shadow policy would have decided for a
+// request, as recorded in the access log.
+type ShadowDecision struct {
+	Policy   string `json:"policy"`
+	Key      string `json:"key,omitempty"`
+	Decision string `json:"decision"`
+}
+
+// shadows returns the shadow policies in use, those given by options
+// first.
+func (ls *LimiterServer) shadows() []*shadow {
+	res := ls.shadowPolicies
+	if rs := ls.currentRules(); rs != nil && len(rs.shadows) > 0 {
+		res = append(res[:len(res):len(res)], rs.shadows...)
+	}
+	return res
+}
+
+// evaluateShadows runs the request past each shadow policy.
+func (ls *LimiterServer) evaluateShadows(r *http.Request, e *AccessEntry) {
+	shadows := ls.shadows()
+	if e != nil && len(shadows) > 0 {
+		e.Shadow = make([]ShadowDecision, len(shadows))
+	}
+	for i, s := range shadows {
+		var slot *ShadowDecision
+		if e != nil {
+			slot = &e.Shadow[i]
+		}
+		s.evaluate(r, e, slot)
+	}
+}
+
+// evaluate decides the request as the shadow policy would, recording the
+// decision in the slot of the access log entry, if there is one, once it
+// is known.
+func (s *shadow) evaluate(r *http.Request, e *AccessEntry,
+	slot *ShadowDecision) {
+	p := s.policy
+	key := p.keyOf(r)
+	decide := func(decision string) {
+		s.record(key, decision)
+		if slot != nil {
+			*slot = ShadowDecision{Policy: p.name, Key: key, Decision: decision}
+		}
+	}
+
+	lim, err := p.limiterFor(key)
+	if err != nil {
+		decide(DecisionError)
+		return
+	}
+	if lim == nil {
+		decide(DecisionUnlimited)
+		return
+	}
+	cost := 1
+	if p.cost == CostBytes && r.ContentLength > 0 {
+		cost = int(r.ContentLength)
+	}
+	if b := limiter.Burst(lim); b > 0 && cost > b {
+		decide(DecisionTooLarge)
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	if ok, err := acquireNow(ctx, lim, cost); ok && err == nil {
+		decide(DecisionAdmitted)
+		return
+	}
+	if p.timeout <= 0 {
+		decide(DecisionRejected)
+		return
+	}
+	select {
+	case s.waiters <- struct{}{}:
+	default:
+		decide(DecisionRejected)
+		return
+	}
+
+	// The access log entry is only written once the decision is in.
+	if e != nil {
+		if e.pending == nil {
+			e.pending = new(sync.WaitGroup)
+		}
+		e.pending.Add(1)
+	}
+	go func() {
+		defer func() { <-s.waiters }()
+		ok, err := limiter.AcquireTokens(ctx, lim, cost, p.timeout)
+		if ok && err == nil {
+			decide(DecisionAdmitted)
+		} else {
+			decide(DecisionRejected)
+		}
+		if e != nil {
+			e.pending.Done()
+		}
+	}()
+}
+
+// record counts a decision.
+func (s *shadow) record(key, decision string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if decision == DecisionAdmitted || decision == DecisionUnlimited {
+		s.admitted++
+		return
+	}
+	s.rejected++
+	if _, ok := s.keys[key]; ok || len(s.keys) < maxShadowKeys {
+		s.keys[key]++
+	}
+}
+
+// stats returns a snapshot of the counts.
+func (s *shadow) stats() ShadowStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := ShadowStats{Policy: s.policy.name, Admitted: s.admitted,
+		Rejected: s.rejected}
+	if len(s.keys) > 0 {
+		st.RejectedKeys = make(map[string]uint64, len(s.keys))
+		for k, n := range s.keys {
+			st.RejectedKeys[k] = n
+		}
+	}
+	return st
+}
+
+// shadowStats returns the counts of every shadow policy.
+func (ls *LimiterServer) shadowStats() []ShadowStats {
+	var res []ShadowStats
+	for _, s := range ls.shadows() {
+		res = append(res, s.stats())
+	}
+	return res
+}
+
+// newShadows creates the shadow policies named by a rule set, carrying
+// over the counts of those whose policies are unchanged.  A shadow
+// policy must not also be in force, as the two would share limiters.
+func newShadows(names []string, policies map[string]*policy,
+	rules []*rule, old *RuleSet) ([]*shadow, error) {
+	var res []*shadow
+	for _, name := range names {
+		p, ok := policies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown shadow policy %q", name)
+		}
+		for i, ru := range rules {
+			if ru.policy == p {
+				return nil, fmt.Errorf("rule %d: policy %q is a shadow policy",
+					i, name)
+			}
+		}
+		s := newShadow(p)
+		if old != nil {
+			for _, prev := range old.shadows {
+				if prev.policy == p {
+					s = prev
+				}
+			}
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// syncBuffer is a buffer that can be written and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) entries(t *testing.T) []AccessEntry {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	var res []AccessEntry
+	sc := bufio.NewScanner(bytes.NewReader(sb.buf.Bytes()))
+	for sc.Scan() {
+		var e AccessEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// Test that a shadow policy records who it would turn away, without
+// turning anyone away, or holding anyone up.
+func TestShadowPolicy(t *testing.T) {
+	b, err := limiter.NewBucketLimiter(1000, limiter.Sec, 100)
+	if err != nil {
+		t.Fatalf("Bucket creation failed: %v\n", err)
+	}
+	var log syncBuffer
+	server := NewLimiterServer(8080, b, time.Second, "http://dummy",
+		WithAccessLog(&log),
+		WithShadowPolicy("strict", PolicyConfig{Algorithm: "bucket", Rate: 1,
+			Interval: "min", Burst: 1, Key: "header:X-API-Key"}),
+		WithShadowPolicy("patient", PolicyConfig{Algorithm: "bucket", Rate: 10,
+			Burst: 1, Timeout: Duration(time.Second)}))
+	h := server.logAccess(server.enforceLimits(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {})))
+
+	for _, key := range []string{"alice", "alice", "bob"} {
+		r := httptest.NewRequest("POST", "/events", nil)
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: shadow policy enforced, got %d", key, w.Code)
+		}
+		if d := time.Since(start); d > 50*time.Millisecond {
+			t.Fatalf("%s: request held up for %v", key, d)
+		}
+	}
+
+	// The patient policy's decisions wait for its tokens.
+	deadline := time.Now().Add(2 * time.Second)
+	var entries []AccessEntry
+	for len(entries) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		entries = log.entries(t)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	// The entries come in as the decisions are made.
+	rejected := make(map[string]int)
+	for _, e := range entries {
+		if len(e.Shadow) != 2 || e.Shadow[1].Decision != DecisionAdmitted {
+			t.Fatalf("unexpected shadow decisions: %+v", e.Shadow)
+		}
+		if e.Shadow[0].Decision == DecisionRejected {
+			rejected[e.Shadow[0].Key]++
+		}
+	}
+	if len(rejected) != 1 || rejected["alice"] != 1 {
+		t.Fatalf("expected one of alice's requests to be rejected, got %v",
+			rejected)
+	}
+
+	st := server.Stats()
+	if len(st.Shadow) != 2 {
+		t.Fatalf("expected 2 shadow policies, got %+v", st.Shadow)
+	}
+	if s := st.Shadow[0]; s.Policy != "strict" || s.Admitted != 2 ||
+		s.Rejected != 1 || len(s.RejectedKeys) != 1 ||
+		s.RejectedKeys["alice"] != 1 {
+		t.Fatalf("unexpected shadow stats: %+v", s)
+	}
+	if s := st.Shadow[1]; s.Admitted != 3 || s.Rejected != 0 {
+		t.Fatalf("unexpected shadow stats: %+v", s)
+	}
+	if st.Admitted != 3 || st.Rejected != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+// Test that only so many requests wait for a shadow policy's tokens, and
+// that the others count as rejected straight away.
+func TestShadowWaiters(t *testing.T) {
+	server := NewLimiterServer(8080, nil, time.Second, "http://dummy",
+		WithShadowPolicy("patient", PolicyConfig{Algorithm: "bucket", Rate: 1,
+			Interval: "min", Burst: 1, Timeout: Duration(time.Second)}))
+	s := server.shadowPolicies[0]
+	s.waiters = make(chan struct{}, 2)
+	for i := 0; i < 5; i++ {
+		s.evaluate(httptest.NewRequest("POST", "/events", nil), nil, nil)
+	}
+	if len(s.waiters) != 2 {
+		t.Fatalf("expected 2 waiters, got %d", len(s.waiters))
+	}
+	if st := s.stats(); st.Admitted != 1 || st.Rejected != 2 {
+		t.Fatalf("unexpected shadow stats: %+v", st)
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// throttledResponseWriter paces the response body sent back to the
+// client with the download limiter.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func newThrottledResponseWriter(ctx context.Context, w http.ResponseWriter,
+	l limiter.Limiter) *throttledResponseWriter {
+	return &throttledResponseWriter{ResponseWriter: w,
+		w: limiter.NewWriter(ctx, w, l)}
+}
+
+func (tw *throttledResponseWriter) Write(p []byte) (int, error) {
+	return tw.w.Write(p)
+}
+
+// Flush sends any buffered data, if the underlying writer supports it.
+func (tw *throttledResponseWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
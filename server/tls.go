@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultCertPoll is how often the certificate files are checked for
+// changes.
+const defaultCertPoll = time.Minute
+
+// TLSFiles gives the files the server terminates TLS with.  The
+// certificate and key files are PEM encoded, and the certificate file
+// may hold the intermediate certificates after the server's own.  If a
+// client CA file is given, clients must present a certificate signed by
+// one of the CAs in it, unless ClientAuth says otherwise.  The files are
+// checked for changes every poll interval, or every minute if that is 0,
+// so that renewed certificates are picked up without a restart.
+type TLSFiles struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   tls.ClientAuthType
+	Poll         time.Duration
+}
+
+// certStore holds the certificate and client CAs loaded from the files,
+// and serves them to each handshake.
+type certStore struct {
+	files TLSFiles
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	cas   *x509.CertPool
+	stamp string // of the files the current ones were loaded from
+}
+
+func newCertStore(files TLSFiles) *certStore {
+	if files.Poll <= 0 {
+		files.Poll = defaultCertPoll
+	}
+	if files.ClientCAFile != "" && files.ClientAuth == tls.NoClientCert {
+		files.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &certStore{files: files}
+}
+
+// load reads the files, if they have changed since they were last read,
+// and reports whether they had.  On error, the current certificate
+// stays in use.
+func (cs *certStore) load() (bool, error) {
+	stamp, err := cs.stampFiles()
+	if err != nil {
+		return false, err
+	}
+	cs.mu.RLock()
+	same := stamp == cs.stamp
+	cs.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cs.files.CertFile, cs.files.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	var cas *x509.CertPool
+	if cs.files.ClientCAFile != "" {
+		pem, err := os.ReadFile(cs.files.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates in %s",
+				cs.files.ClientCAFile)
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.cert, cs.cas, cs.stamp = &cert, cas, stamp
+	return true, nil
+}
+
+// stampFiles returns a string that changes whenever one of the files
+// does.
+func (cs *certStore) stampFiles() (string, error) {
+	var stamp string
+	for _, f := range []string{cs.files.CertFile, cs.files.KeyFile,
+		cs.files.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	return stamp, nil
+}
+
+// watch reloads the files whenever they change.  It is a blocking call
+// that returns once the context is canceled.
+func (cs *certStore) watch(ctx context.Context) {
+	t := time.NewTicker(cs.files.Poll)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if changed, err := cs.load(); err != nil {
+			log.Printf("Certificate in %s rejected: %v\n", cs.files.CertFile,
+				err)
+		} else if changed {
+			log.Printf("Certificate reloaded from %s\n", cs.files.CertFile)
+		}
+	}
+}
+
+// config returns a TLS configuration that uses whatever certificate and
+// client CAs are current at the time of each handshake.
+func (cs *certStore) config() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: cs.files.ClientAuth,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cs.mu.RLock()
+			defer cs.mu.RUnlock()
+			if cs.cert == nil {
+				return nil, errors.New("no certificate loaded")
+			}
+			return cs.cert, nil
+		},
+	}
+	if cs.files.ClientCAFile == "" {
+		return base
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientCAs = cs.cas
+		return cfg, nil
+	}
+	return base
+}
+
+// clientCert returns the client's certificate, if it presented one that
+// was verified against the client CAs.
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 ||
+		len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// CertSubjectKey keys requests by the common name in the subject of the
+// client's certificate.  Only certificates verified against the client
+// CAs count, so requests without one all share the empty key.
+func CertSubjectKey() KeyFunc {
+	return func(r *http.Request) string {
+		if c := clientCert(r); c != nil {
+			return c.Subject.CommonName
+		}
+		return ""
+	}
+}
+
+// CertSANKey keys requests by the first subject alternative name of the
+// client's verified certificate, taking a URI, such as a SPIFFE ID, over
+// a DNS name, an email address or an IP address, in that order.
+func CertSANKey() KeyFunc {
+	return func(r *http.Request) string {
+		c := clientCert(r)
+		switch {
+		case c == nil:
+			return ""
+		case len(c.URIs) > 0:
+			return c.URIs[0].String()
+		case len(c.DNSNames) > 0:
+			return c.DNSNames[0]
+		case len(c.EmailAddresses) > 0:
+			return c.EmailAddresses[0]
+		case len(c.IPAddresses) > 0:
+			return c.IPAddresses[0].String()
+		}
+		return ""
+	}
+}
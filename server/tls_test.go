@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// issue creates a certificate for the given name, signed by the parent,
+// or self-signed as a CA if there is none.  It returns the certificate
+// along with its PEM encoding, and that of its key.
+func issue(t *testing.T, name string, parent *tls.Certificate) (
+	tls.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey,
+		signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	kder, _ := x509.MarshalECPrivateKey(key)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key,
+			Leaf: leaf},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+}
+
+// Test that clients must present a certificate signed by the client CA,
+// and are each limited by the identity in it.
+func TestMutualTLS(t *testing.T) {
+	ca, _, _ := issue(t, "ca", nil)
+	srvCert, _, _ := issue(t, "localhost", &ca)
+	cas := x509.NewCertPool()
+	cas.AddCert(ca.Leaf)
+
+	reg := limiter.NewRegistry(func(string) (limiter.Limiter, error) {
+		return limiter.NewBucketLimiter(1, limiter.Min, 1)
+	}, time.Minute, 0)
+	server := NewLimiterServer(0, nil, 10*time.Millisecond, "http://dummy",
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{srvCert},
+			ClientCAs: cas, ClientAuth: tls.RequireAndVerifyClientCert}),
+		WithKeyedLimits(reg, CertSubjectKey()), WithRoutes("/"))
+	// Answer locally, rather than proxying.
+	server.handler = server.enforceLimits(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Serve(ctx, ln)
+	}()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	get := func(cert *tls.Certificate) (int, error) {
+		cfg := &tls.Config{RootCAs: x509.NewCertPool()}
+		cfg.RootCAs.AddCert(ca.Leaf)
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		cli := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := cli.Get("https://" + ln.Addr().String() + "/events")
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	alice, _, _ := issue(t, "alice", &ca)
+	bob, _, _ := issue(t, "bob", &ca)
+	for i, tc := range []struct {
+		cert   *tls.Certificate
+		status int
+	}{
+		{&alice, http.StatusOK},
+		{&alice, http.StatusServiceUnavailable},
+		{&bob, http.StatusOK},
+	} {
+		status, err := get(tc.cert)
+		if err != nil {
+			t.Fatalf("%d: Get failed: %v", i, err)
+		}
+		if status != tc.status {
+			t.Fatalf("%d: expected status %d, got %d", i, tc.status, status)
+		}
+	}
+
+	// Neither a missing certificate, nor one from another CA, will do.
+	other, _, _ := issue(t, "other", nil)
+	mallory, _, _ := issue(t, "mallory", &other)
+	for _, cert := range []*tls.Certificate{nil, &mallory} {
+		if _, err := get(cert); err == nil {
+			t.Fatalf("expected the handshake to fail")
+		}
+	}
+	if n := reg.Len(); n != 2 {
+		t.Fatalf("expected 2 keys, got %d", n)
+	}
+}
+
+// Test that renewed certificates are picked up, and that invalid ones
+// are rejected in favor of the current one.
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	files := TLSFiles{CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile: filepath.Join(dir, "key.pem")}
+	write := func(cert, key []byte, at time.Time) {
+		for f, b := range map[string][]byte{files.CertFile: cert,
+			files.KeyFile: key} {
+			if err := os.WriteFile(f, b, 0600); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			os.Chtimes(f, at, at)
+		}
+	}
+	current := func(cs *certStore) *big.Int {
+		c, err := cs.config().GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate failed: %v", err)
+		}
+		leaf, _ := x509.ParseCertificate(c.Certificate[0])
+		return leaf.SerialNumber
+	}
+
+	first, certPEM, keyPEM := issue(t, "localhost", nil)
+	now := time.Now()
+	write(certPEM, keyPEM, now)
+	cs := newCertStore(files)
+	if changed, err := cs.load(); !changed || err != nil {
+		t.Fatalf("expected the certificate to load: %t, %v", changed, err)
+	}
+	if changed, _ := cs.load(); changed {
+		t.Fatalf("expected no change")
+	}
+
+	second, certPEM, keyPEM := issue(t, "localhost", nil)
+	write(certPEM, keyPEM, now.Add(time.Second))
+	if changed, err := cs.load(); !changed || err != nil {
+		t.Fatalf("expected the certificate to reload: %t, %v", changed, err)
+	}
+	if current(cs).Cmp(second.Leaf.SerialNumber) != 0 {
+		t.Fatalf("expected the renewed certificate")
+	}
+
+	write(certPEM, []byte(strings.Repeat("x", len(keyPEM))),
+		now.Add(2*time.Second))
+	if _, err := cs.load(); err == nil {
+		t.Fatalf("expected an invalid key to be rejected")
+	}
+	if s := current(cs); s.Cmp(second.Leaf.SerialNumber) != 0 ||
+		s.Cmp(first.Leaf.SerialNumber) == 0 {
+		t.Fatalf("expected the current certificate to stay in use")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdotgordon/rate_limiter/limiter"
+)
+
+// Clients may say how long they're prepared to wait for a token, either
+// with the X-RateLimit-Max-Wait header, as a duration such as "250ms" or
+// a number of seconds, or with the "wait" preference of the Prefer header
+// from RFC 7240, as a number of seconds.  An interactive caller might
+// send a wait of 0 to fail fast, while a batch caller could wait several
+// seconds.  The wait is only honoured if the server has a ceiling for
+// it, and is capped at that ceiling, as otherwise the policy's timeout
+// applies.
+const (
+	maxWaitHeader = "X-RateLimit-Max-Wait"
+	preferHeader  = "Prefer"
+)
+
+// waitFor returns how long the request may wait for its tokens, and
+// whether it asked not to wait at all.
+func (ls *LimiterServer) waitFor(w http.ResponseWriter, r *http.Request,
+	p *policy) (time.Duration, bool) {
+	if ls.maxClientWait <= 0 {
+		return p.waitTimeout(), false
+	}
+	d, prefer, ok := clientWait(r, ls.maxClientWait)
+	if !ok {
+		return p.waitTimeout(), false
+	}
+	if prefer {
+		w.Header().Set("Preference-Applied", "wait="+
+			strconv.Itoa(int(d/time.Second)))
+	}
+	return d, d == 0
+}
+
+// clientWait returns the wait asked for by the client, if any, capped at
+// the ceiling, and whether it came from the Prefer header.  Invalid
+// values are ignored.
+func clientWait(r *http.Request, ceiling time.Duration) (time.Duration, bool,
+	bool) {
+	if v := r.Header.Get(maxWaitHeader); v != "" {
+		if d, ok := parseWait(v, ceiling); ok {
+			return d, false, true
+		}
+	}
+	for _, v := range r.Header.Values(preferHeader) {
+		for _, pref := range strings.Split(v, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(pref), "=")
+			if !strings.EqualFold(strings.TrimSpace(name), "wait") {
+				continue
+			}
+			secs, err := strconv.Atoi(strings.Trim(strings.TrimSpace(val),
+				`"`))
+			if err == nil && secs >= 0 {
+				return capWait(float64(secs), ceiling), true, true
+			}
+		}
+	}
+	return 0, false, false
+}
+
+// parseWait parses a duration, or a number of seconds, capped at the
+// ceiling.
+func parseWait(v string, ceiling time.Duration) (time.Duration, bool) {
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		if math.IsNaN(secs) || math.IsInf(secs, 0) || secs < 0 {
+			return 0, false
+		}
+		return capWait(secs, ceiling), true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, false
+	}
+	if d > ceiling {
+		d = ceiling
+	}
+	return d, true
+}
+
+// capWait converts a number of seconds to a duration, capped at the
+// ceiling.  The cap is applied first, as a large enough number would
+// overflow the duration.
+func capWait(secs float64, ceiling time.Duration) time.Duration {
+	if secs >= ceiling.Seconds() {
+		return ceiling
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// acquireNow takes n tokens only if they're available right away.
+func acquireNow(ctx context.Context, lim limiter.Limiter, n int) (bool,
+	error) {
+	if n == 1 {
+		return lim.TryAcquireToken(ctx)
+	}
+	// Interpolating limiters turn away requests they can't satisfy in
+	// time, without waiting.
+	return limiter.AcquireTokens(ctx, lim, n, time.Nanosecond)
+}